@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"debug/elf"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+)
+
+// Architectures Firecracker runs on, by Go and ELF name
+var goArchs = map[string]string{
+	"amd64": "x86_64",
+	"arm64": "aarch64",
+}
+
+var elfArchs = map[elf.Machine]string{
+	elf.EM_X86_64:  "x86_64",
+	elf.EM_AARCH64: "aarch64",
+}
+
+// An aarch64 kernel Image has this magic at offset 0x38
+var arm64ImageMagic = []byte("ARM\x64")
+
+func hostArch() string {
+	if arch, ok := goArchs[runtime.GOARCH]; ok {
+		return arch
+	}
+	return runtime.GOARCH
+}
+
+// Tell the architecture of a guest kernel, either an ELF vmlinux or an
+// aarch64 Image.
+func kernelArch(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	if e, err := elf.NewFile(f); err == nil {
+		if arch, ok := elfArchs[e.Machine]; ok {
+			return arch, nil
+		}
+		return e.Machine.String(), nil
+	}
+
+	magic := make([]byte, len(arm64ImageMagic))
+	if _, err := f.ReadAt(magic, 0x38); err != nil && err != io.EOF {
+		return "", err
+	}
+	if bytes.Equal(magic, arm64ImageMagic) {
+		return "aarch64", nil
+	}
+	return "", fmt.Errorf("%s is neither an ELF kernel nor an aarch64 Image", path)
+}
+
+// Make sure the guest kernel is built for the host.
+func checkKernelArch(path string) error {
+	arch, err := kernelArch(path)
+	if err != nil {
+		return err
+	}
+	if arch != hostArch() {
+		return fmt.Errorf("kernel %s is built for %s but the host is %s, use -skip-arch-check to boot it anyway",
+			path, arch, hostArch())
+	}
+	return nil
+}
+
+// Make sure a snapshot was taken on a host of the same architecture.
+func checkSnapshotArch(snapshotPath string) error {
+	// An unknown format version still has a valid magic
+	h, err := readStateHeader(snapshotPath + ".file")
+	if h == nil {
+		return err
+	}
+	if h.arch != hostArch() {
+		return fmt.Errorf("snapshot %s was taken on %s but the host is %s, use -skip-arch-check to restore it anyway",
+			snapshotPath, h.arch, hostArch())
+	}
+	return nil
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"debug/elf"
+	"encoding/binary"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// An ELF64 header with no sections nor program headers, enough for
+// debug/elf
+func elfHeader(machine elf.Machine) []byte {
+	h := make([]byte, 64)
+	copy(h, elf.ELFMAG)
+	h[elf.EI_CLASS] = byte(elf.ELFCLASS64)
+	h[elf.EI_DATA] = byte(elf.ELFDATA2LSB)
+	h[elf.EI_VERSION] = byte(elf.EV_CURRENT)
+	le := binary.LittleEndian
+	le.PutUint16(h[16:], uint16(elf.ET_EXEC))
+	le.PutUint16(h[18:], uint16(machine))
+	le.PutUint32(h[20:], uint32(elf.EV_CURRENT))
+	// e_ehsize, e_phentsize and e_shentsize
+	le.PutUint16(h[52:], 64)
+	le.PutUint16(h[54:], 56)
+	le.PutUint16(h[58:], 64)
+	return h
+}
+
+// The start of an aarch64 kernel Image, up to its magic
+func arm64Image() []byte {
+	h := make([]byte, 0x40)
+	copy(h[0x38:], arm64ImageMagic)
+	return h
+}
+
+func writeKernel(t *testing.T, data []byte) string {
+	path := filepath.Join(t.TempDir(), "kernel")
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestKernelArch(t *testing.T) {
+	for _, c := range []struct {
+		name string
+		data []byte
+		want string
+	}{
+		{"x86_64 vmlinux", elfHeader(elf.EM_X86_64), "x86_64"},
+		{"aarch64 vmlinux", elfHeader(elf.EM_AARCH64), "aarch64"},
+		{"riscv vmlinux", elfHeader(elf.EM_RISCV), elf.EM_RISCV.String()},
+		{"aarch64 Image", arm64Image(), "aarch64"},
+	} {
+		arch, err := kernelArch(writeKernel(t, c.data))
+		if err != nil {
+			t.Errorf("%s: %v", c.name, err)
+			continue
+		}
+		if arch != c.want {
+			t.Errorf("%s: got %s, want %s", c.name, arch, c.want)
+		}
+	}
+
+	if _, err := kernelArch(writeKernel(t, make([]byte, 0x40))); err == nil {
+		t.Errorf("no error for a file that's neither an ELF nor an Image")
+	}
+}
+
+func TestCheckKernelArch(t *testing.T) {
+	host, other := elf.EM_X86_64, elf.EM_AARCH64
+	if hostArch() == "aarch64" {
+		host, other = other, host
+	}
+
+	if err := checkKernelArch(writeKernel(t, elfHeader(host))); err != nil {
+		t.Errorf("kernel built for the host refused: %v", err)
+	}
+
+	err := checkKernelArch(writeKernel(t, elfHeader(other)))
+	if err == nil || !strings.Contains(err.Error(), "-skip-arch-check") {
+		t.Errorf("ELF kernel for %s not refused on %s: %v", elfArchs[other], hostArch(), err)
+	}
+
+	err = checkKernelArch(writeKernel(t, arm64Image()))
+	if hostArch() == "aarch64" {
+		if err != nil {
+			t.Errorf("aarch64 Image refused on aarch64: %v", err)
+		}
+	} else if err == nil || !strings.Contains(err.Error(), "-skip-arch-check") {
+		t.Errorf("aarch64 Image not refused on %s: %v", hostArch(), err)
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	firecracker "github.com/firecracker-microvm/firecracker-go-sdk"
+)
+
+// Flush a file to disk.
+func syncFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Sync()
+}
+
+func mibPerSec(bytes int64, d time.Duration) float64 {
+	return float64(bytes) / (1 << 20) / d.Seconds()
+}
+
+// Take runs full snapshots of the VM behind socketPath under prefix and
+// print the write throughput of each and on average, both as Firecracker
+// reports it done and once the memory file is synced to disk. The VM runs
+// between snapshots and the snapshots are removed. Snapshots are never
+// compressed, so there is only the raw throughput.
+func benchSnapshot(socketPath string, prefix string, runs int) {
+	if runs <= 0 {
+		panic(fmt.Errorf("-bench-runs must be positive, got %d", runs))
+	}
+
+	ctx := context.Background()
+	cfg := firecracker.Config{SocketPath: socketPath}
+	machine, err := firecracker.NewMachine(ctx, cfg, firecracker.WithClient(newAPIClient(cfg.SocketPath)),
+		firecracker.WithLogger(log.NewEntry(log.New())))
+	if err != nil {
+		panic(fmt.Errorf("failed to create new machine: %v", err))
+	}
+
+	var total, totalSynced time.Duration
+	var createTimes, syncTimes []time.Duration
+	var size int64
+	for i := 1; i <= runs; i++ {
+		snapshotPath := fmt.Sprintf("%s-%d", prefix, i)
+		registerSnapshot(snapshotPath)
+		if err := pauseWithRetry(ctx, machine); err != nil {
+			panic(err)
+		}
+		start := time.Now()
+		err := fullSnapshot(ctx, machine, snapshotPath)
+		created := time.Since(start)
+		if err == nil {
+			err = syncFile(snapshotPath + ".mem")
+		}
+		synced := time.Since(start)
+		machine.ResumeVM(ctx)
+
+		var info os.FileInfo
+		if err == nil {
+			info, err = os.Stat(snapshotPath + ".mem")
+		}
+		os.Remove(snapshotPath + ".mem")
+		os.Remove(snapshotPath + ".file")
+		if err != nil {
+			panic(fmt.Errorf("snapshot %d failed: %v", i, err))
+		}
+
+		size = info.Size()
+		total += created
+		totalSynced += synced
+		createTimes = append(createTimes, created)
+		syncTimes = append(syncTimes, synced)
+		fmt.Printf("Run %d: %d MiB in %v (%.0f MiB/s), synced in %v (%.0f MiB/s)\n",
+			i, size>>20, created, mibPerSec(size, created), synced, mibPerSec(size, synced))
+	}
+
+	avg, avgSynced := total/time.Duration(runs), totalSynced/time.Duration(runs)
+	fmt.Printf("Average over %d runs: %.0f MiB/s, %.0f MiB/s synced\n",
+		runs, mibPerSec(size, avg), mibPerSec(size, avgSynced))
+	summary.latencies("create_snapshot", createTimes)
+	summary.latencies("create_snapshot_synced", syncTimes)
+	summary.size("mem_file", size)
+	summary.value("mib_per_s", mibPerSec(size, avg))
+	summary.value("mib_per_s_synced", mibPerSec(size, avgSynced))
+}
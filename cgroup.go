@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// Where the cgroup hierarchies are mounted, a variable for the tests
+var cgroupRoot = "/sys/fs/cgroup"
+
+// CFS period used for -cgroup-cpu quotas
+const cpuPeriodUs = 100000
+
+// Resource limits for the cgroup of a VMM process, zero for none
+type cgroupLimits struct {
+	memBytes int64
+	cpus     float64
+}
+
+func (l cgroupLimits) empty() bool {
+	return l.memBytes == 0 && l.cpus == 0
+}
+
+func writeCgroupFile(dir string, file string, value string) error {
+	if err := ioutil.WriteFile(filepath.Join(dir, file), []byte(value), 0644); err != nil {
+		return fmt.Errorf("failed to set %s: %v", file, err)
+	}
+	return nil
+}
+
+// Put pid into a new cgroup named name with the limits, under the unified
+// hierarchy if the host has it and the memory and cpu controllers of the
+// legacy one otherwise. Returns a function removing the cgroup once the
+// process has exited.
+func joinCgroup(name string, pid int, limits cgroupLimits) (func(), error) {
+	quota := strconv.FormatInt(int64(limits.cpus*cpuPeriodUs), 10)
+	procs := strconv.Itoa(pid)
+
+	if _, err := os.Stat(filepath.Join(cgroupRoot, "cgroup.controllers")); err == nil {
+		// cgroup v2: both limits in one group, the controllers have to be
+		// enabled for the children of the root first
+		ioutil.WriteFile(filepath.Join(cgroupRoot, "cgroup.subtree_control"), []byte("+memory +cpu"), 0644)
+		dir := filepath.Join(cgroupRoot, name)
+		if err := os.Mkdir(dir, 0755); err != nil {
+			return nil, err
+		}
+		registerCgroup(dir)
+		cleanup := func() { os.Remove(dir) }
+		err := error(nil)
+		if limits.memBytes != 0 {
+			err = writeCgroupFile(dir, "memory.max", strconv.FormatInt(limits.memBytes, 10))
+		}
+		if err == nil && limits.cpus != 0 {
+			err = writeCgroupFile(dir, "cpu.max", quota+" "+strconv.Itoa(cpuPeriodUs))
+		}
+		if err == nil {
+			err = writeCgroupFile(dir, "cgroup.procs", procs)
+		}
+		if err != nil {
+			cleanup()
+			return nil, err
+		}
+		return cleanup, nil
+	}
+
+	// cgroup v1: one group per controller
+	var dirs []string
+	cleanup := func() {
+		for _, dir := range dirs {
+			os.Remove(dir)
+		}
+	}
+	join := func(controller string, file string, value string) error {
+		dir := filepath.Join(cgroupRoot, controller, name)
+		if err := os.Mkdir(dir, 0755); err != nil {
+			return err
+		}
+		dirs = append(dirs, dir)
+		registerCgroup(dir)
+		if controller == "cpu" {
+			if err := writeCgroupFile(dir, "cpu.cfs_period_us", strconv.Itoa(cpuPeriodUs)); err != nil {
+				return err
+			}
+		}
+		if err := writeCgroupFile(dir, file, value); err != nil {
+			return err
+		}
+		return writeCgroupFile(dir, "cgroup.procs", procs)
+	}
+	var err error
+	if limits.memBytes != 0 {
+		err = join("memory", "memory.limit_in_bytes", strconv.FormatInt(limits.memBytes, 10))
+	}
+	if err == nil && limits.cpus != 0 {
+		err = join("cpu", "cpu.cfs_quota_us", quota)
+	}
+	if err != nil {
+		cleanup()
+		return nil, err
+	}
+	return cleanup, nil
+}
+
+// Name of the cgroup of the VMM serving socketPath. Clones of a pool or of
+// the density test all have an api.sock, in their own directories, so the
+// whole path is hashed in.
+func cgroupName(socketPath string) string {
+	h := fnv.New32a()
+	h.Write([]byte(socketPath))
+	return fmt.Sprintf("launcher-%d-%s-%08x", os.Getpid(), filepath.Base(socketPath), h.Sum32())
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+// Point cgroupRoot at a temporary directory for the test
+func fakeCgroupRoot(t *testing.T) string {
+	root := t.TempDir()
+	saved := cgroupRoot
+	cgroupRoot = root
+	t.Cleanup(func() { cgroupRoot = saved })
+	return root
+}
+
+func checkCgroupFile(t *testing.T, dir string, file string, want string) {
+	t.Helper()
+	data, err := ioutil.ReadFile(filepath.Join(dir, file))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if string(data) != want {
+		t.Errorf("%s: got %q, want %q", file, data, want)
+	}
+}
+
+var testLimits = cgroupLimits{memBytes: 256 << 20, cpus: 1.5}
+
+func TestJoinCgroupV2(t *testing.T) {
+	root := fakeCgroupRoot(t)
+	if err := ioutil.WriteFile(filepath.Join(root, "cgroup.controllers"), []byte("cpu memory"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := joinCgroup("vm", 4242, testLimits); err != nil {
+		t.Fatal(err)
+	}
+	checkCgroupFile(t, root, "cgroup.subtree_control", "+memory +cpu")
+	dir := filepath.Join(root, "vm")
+	checkCgroupFile(t, dir, "memory.max", "268435456")
+	checkCgroupFile(t, dir, "cpu.max", "150000 100000")
+	checkCgroupFile(t, dir, "cgroup.procs", "4242")
+}
+
+func TestJoinCgroupV1(t *testing.T) {
+	root := fakeCgroupRoot(t)
+	for _, controller := range []string{"memory", "cpu"} {
+		if err := os.Mkdir(filepath.Join(root, controller), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := joinCgroup("vm", 4242, testLimits); err != nil {
+		t.Fatal(err)
+	}
+	mem := filepath.Join(root, "memory", "vm")
+	checkCgroupFile(t, mem, "memory.limit_in_bytes", "268435456")
+	checkCgroupFile(t, mem, "cgroup.procs", "4242")
+	cpu := filepath.Join(root, "cpu", "vm")
+	checkCgroupFile(t, cpu, "cpu.cfs_period_us", "100000")
+	checkCgroupFile(t, cpu, "cpu.cfs_quota_us", "150000")
+	checkCgroupFile(t, cpu, "cgroup.procs", "4242")
+}
+
+// Only the cgroups of the limits that are set get made
+func TestJoinCgroupV1MemoryOnly(t *testing.T) {
+	root := fakeCgroupRoot(t)
+	if err := os.Mkdir(filepath.Join(root, "memory"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := joinCgroup("vm", 4242, cgroupLimits{memBytes: 1 << 30}); err != nil {
+		t.Fatal(err)
+	}
+	checkCgroupFile(t, filepath.Join(root, "memory", "vm"), "cgroup.procs", "4242")
+	if _, err := os.Stat(filepath.Join(root, "cpu")); !os.IsNotExist(err) {
+		t.Errorf("cpu cgroup made without a cpu limit: %v", err)
+	}
+}
+
+func TestJoinCgroupV1MissingController(t *testing.T) {
+	root := fakeCgroupRoot(t)
+	if err := os.Mkdir(filepath.Join(root, "memory"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := joinCgroup("vm", 4242, testLimits); err == nil {
+		t.Fatal("no error without a cpu controller")
+	}
+}
+
+// The clones of -vsock-serve and -density-test each have an api.sock
+func TestCgroupNameClones(t *testing.T) {
+	first := cgroupName("/run/vm.sock.pool/vm-0/api.sock")
+	second := cgroupName("/run/vm.sock.pool/vm-1/api.sock")
+	if first == second {
+		t.Fatalf("both clones get cgroup %s", first)
+	}
+	if again := cgroupName("/run/vm.sock.pool/vm-0/api.sock"); again != first {
+		t.Errorf("got %s and %s for the same socket", first, again)
+	}
+
+	root := fakeCgroupRoot(t)
+	if err := ioutil.WriteFile(filepath.Join(root, "cgroup.controllers"), []byte("cpu memory"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	limits := cgroupLimits{memBytes: 256 << 20}
+	for i, name := range []string{first, second} {
+		if _, err := joinCgroup(name, 4242+i, limits); err != nil {
+			t.Errorf("clone %d: %v", i, err)
+		}
+	}
+}
+
+// -density-test with -cgroup-mem, on a cgroup v1 host
+func TestCgroupNameDensityClones(t *testing.T) {
+	root := fakeCgroupRoot(t)
+	if err := os.Mkdir(filepath.Join(root, "memory"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		socket := filepath.Join("/run/vm.sock.density", strconv.Itoa(i), "api.sock")
+		if _, err := joinCgroup(cgroupName(socket), 4242+i, cgroupLimits{memBytes: 1 << 30}); err != nil {
+			t.Fatalf("clone %d: %v", i, err)
+		}
+	}
+}
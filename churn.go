@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	firecracker "github.com/firecracker-microvm/firecracker-go-sdk"
+	ops "github.com/firecracker-microvm/firecracker-go-sdk/client/operations"
+)
+
+// Take a diff snapshot of the VM behind socketPath every interval for
+// duration and print, as CSV, how many pages the guest dirtied in each
+// interval. The diffs are thrown away, the VM runs between them.
+func trackChurn(socketPath string, interval time.Duration, duration time.Duration) {
+	if interval <= 0 || duration <= 0 {
+		panic(fmt.Errorf("-track-churn and -duration must be positive"))
+	}
+
+	ctx := context.Background()
+	cfg := firecracker.Config{SocketPath: socketPath}
+	machine, err := firecracker.NewMachine(ctx, cfg, firecracker.WithClient(newAPIClient(cfg.SocketPath)),
+		firecracker.WithLogger(log.NewEntry(log.New())))
+	if err != nil {
+		panic(fmt.Errorf("failed to create new machine: %v", err))
+	}
+
+	diff := socketPath + ".churn"
+	registerSnapshot(diff)
+	defer os.Remove(diff + ".mem")
+	defer os.Remove(diff + ".file")
+
+	out := csv.NewWriter(os.Stdout)
+	out.Write([]string{"elapsed_s", "dirty_pages", "diff_bytes", "snapshot_ms"})
+
+	start := time.Now()
+	// The first diff holds everything dirtied since boot or the last
+	// snapshot, it only sets the baseline
+	for n := 0; time.Since(start) <= duration; n++ {
+		if err := pauseWithRetry(ctx, machine); err != nil {
+			panic(err)
+		}
+		snapStart := time.Now()
+		err := machine.CreateSnapshot(ctx, diff+".mem", diff+".file",
+			func(data *ops.CreateSnapshotParams) {
+				data.Body.SnapshotType = "Diff"
+			})
+		snapTime := time.Since(snapStart)
+		machine.ResumeVM(ctx)
+		if err != nil {
+			panic(fmt.Errorf("failed to create snapshot: %v", err))
+		}
+
+		bytes, err := allocatedSize(diff + ".mem")
+		if err != nil {
+			panic(err)
+		}
+		os.Remove(diff + ".mem")
+
+		if n > 0 {
+			out.Write([]string{
+				strconv.FormatFloat(time.Since(start).Seconds(), 'f', 1, 64),
+				strconv.FormatInt(bytes/pageSize, 10),
+				strconv.FormatInt(bytes, 10),
+				strconv.FormatFloat(float64(snapTime)/float64(time.Millisecond), 'f', 1, 64),
+			})
+			out.Flush()
+		}
+		time.Sleep(interval)
+	}
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime/debug"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Whether everything the launcher creates is removed when it exits, set by
+// -once
+var onceMode bool
+
+// Something the launcher created: a file, a process, a cgroup, a network
+// namespace or a TAP device
+type resource struct {
+	kind   string
+	name   string
+	remove func() error
+	// Whether it's gone, checked before and after remove
+	gone func() bool
+}
+
+var (
+	resources   []*resource
+	resourcesMu sync.Mutex
+)
+
+// Register a resource for removal on exit. Without -once this does
+// nothing, resources are then left to the code that created them.
+// Returns a function that unregisters it, for resources removed before.
+func registerResource(kind string, name string, remove func() error, gone func() bool) func() {
+	if !onceMode {
+		return func() {}
+	}
+	resourcesMu.Lock()
+	defer resourcesMu.Unlock()
+	r := &resource{kind: kind, name: name, remove: remove, gone: gone}
+	resources = append(resources, r)
+	return func() {
+		resourcesMu.Lock()
+		defer resourcesMu.Unlock()
+		for i, other := range resources {
+			if other == r {
+				resources = append(resources[:i], resources[i+1:]...)
+				return
+			}
+		}
+	}
+}
+
+func pathGone(path string) func() bool {
+	return func() bool {
+		_, err := os.Lstat(path)
+		return os.IsNotExist(err)
+	}
+}
+
+// Register a file, or a directory with everything in it.
+func registerPath(kind string, path string) {
+	registerResource(kind, path, func() error { return os.RemoveAll(path) }, pathGone(path))
+}
+
+// Register the files of a snapshot.
+func registerSnapshot(snapshotPath string) {
+	for _, path := range []string{snapshotPath + ".mem", snapshotPath + ".file", manifestPath(snapshotPath)} {
+		registerPath("snapshot file", path)
+	}
+}
+
+// Register a cgroup directory. It can only be removed once its processes
+// are gone.
+func registerCgroup(dir string) {
+	registerResource("cgroup", dir, func() error { return os.Remove(dir) }, pathGone(dir))
+}
+
+// Register a VMM, killed on exit. The returned function unregisters it and
+// must be called once it's reaped: its pid can then be reused by another
+// process.
+func registerProcess(pid int) func() {
+	return registerResource("process", strconv.Itoa(pid), func() error {
+		if err := syscall.Kill(pid, syscall.SIGKILL); err != nil && err != syscall.ESRCH {
+			return err
+		}
+		// Its cgroup can't be removed before it's gone
+		for i := 0; i < 100 && !processGone(pid); i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		return nil
+	}, func() bool { return processGone(pid) })
+}
+
+func registerNetNS(name string) {
+	registerResource("network namespace", name, func() error {
+		return runIP("netns", "del", name)
+	}, pathGone(filepath.Join(netnsDir, name)))
+}
+
+func registerTap(netNS string, tap string) {
+	registerResource("TAP device", netNS+"/"+tap, func() error {
+		return runIP("-n", netNS, "link", "del", tap)
+	}, func() bool {
+		return runIP("-n", netNS, "link", "show", tap) != nil
+	})
+}
+
+// Remove the registered resources, newest first, and check that they're
+// gone. Logs and returns the number of those that are left.
+func cleanupResources() int {
+	resourcesMu.Lock()
+	list := resources
+	resources = nil
+	resourcesMu.Unlock()
+
+	left := 0
+	for i := len(list) - 1; i >= 0; i-- {
+		r := list[i]
+		if r.gone() {
+			continue
+		}
+		err := r.remove()
+		if r.gone() {
+			log.Debugf("Removed %s %s", r.kind, r.name)
+			continue
+		}
+		left++
+		if err != nil {
+			log.Errorf("failed to remove %s %s: %v", r.kind, r.name, err)
+		} else {
+			log.Errorf("failed to remove %s %s: still there", r.kind, r.name)
+		}
+	}
+	if len(list) != 0 && left == 0 {
+		log.Infof("Removed all %d resources created by the launcher", len(list))
+	}
+	return left
+}
+
+// Parent of the contexts of the VMMs the launcher starts, cancelling it
+// kills them. untilSignal cancels it on SIGINT and SIGTERM.
+var vmmContext = context.Background()
+
+// Whether a signal stopped the VMMs, their exit is no error then.
+func stopping() bool {
+	return vmmContext.Err() != nil
+}
+
+// Run f and return its exit code. With catch, a SIGINT or SIGTERM kills the
+// VMMs the launcher started, so that f returns and its deferred functions
+// undo the host setup, then exitFailure is returned rather than the signal
+// killing the launcher, so that the deferred functions of the caller run
+// too. A second signal stops waiting for f. Panics of f are passed on with
+// their stack.
+func untilSignal(catch bool, f func() int) int {
+	if !catch {
+		return f()
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	vmmContext = ctx
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	done := make(chan int, 1)
+	panics := make(chan error, 1)
+	go func() {
+		defer func() {
+			if p := recover(); p != nil {
+				panics <- fmt.Errorf("%v\n\n%s", p, debug.Stack())
+			}
+		}()
+		done <- f()
+	}()
+
+	var stoppedBy os.Signal
+	for {
+		select {
+		case code := <-done:
+			if stoppedBy != nil {
+				return exitFailure
+			}
+			return code
+		case err := <-panics:
+			if stoppedBy != nil {
+				// Most likely because its VMM was killed
+				log.Debugf("Failed after %v: %v", stoppedBy, err)
+				return exitFailure
+			}
+			panic(err)
+		case sig := <-signals:
+			if stoppedBy != nil {
+				log.Warnf("Got %v again, not waiting for the VMs to stop", sig)
+				return exitFailure
+			}
+			stoppedBy = sig
+			log.Warnf("Got %v, stopping the VMs", sig)
+			cancel()
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestUntilSignalWaitsForF(t *testing.T) {
+	defer func() { vmmContext = context.Background() }()
+
+	cleanedUp := false
+	code := untilSignal(true, func() int {
+		defer func() { cleanedUp = true }()
+		syscall.Kill(syscall.Getpid(), syscall.SIGTERM)
+		// Like a VMM killed by the cancellation
+		<-vmmContext.Done()
+		return exitOK
+	})
+	if code != exitFailure {
+		t.Errorf("got exit code %d, want %d", code, exitFailure)
+	}
+	if !cleanedUp {
+		t.Error("returned before f did")
+	}
+	if !stopping() {
+		t.Error("VMM context not cancelled")
+	}
+}
+
+func TestUntilSignalPanicStack(t *testing.T) {
+	defer func() { vmmContext = context.Background() }()
+	defer func() {
+		p := recover()
+		if p == nil {
+			t.Fatal("panic not passed on")
+		}
+		msg := fmt.Sprint(p)
+		if !strings.HasPrefix(msg, "boom") || !strings.Contains(msg, "TestUntilSignalPanicStack") {
+			t.Errorf("panic without the stack of f: %s", msg)
+		}
+	}()
+	untilSignal(true, func() int { panic(fmt.Errorf("boom")) })
+}
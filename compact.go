@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// lseek(2) whence values for walking the data of sparse files
+const (
+	seekData = 3
+	seekHole = 4
+)
+
+// A diff snapshot chain, base snapshot first. Relative paths are relative to
+// the chain file.
+type snapshotChain struct {
+	Snapshots []string `json:"snapshots"`
+}
+
+func readChain(chainPath string) ([]string, error) {
+	var chain snapshotChain
+	if err := readJSON(chainPath, &chain); err != nil {
+		return nil, fmt.Errorf("invalid chain %s: %v", chainPath, err)
+	}
+	if len(chain.Snapshots) == 0 {
+		return nil, fmt.Errorf("chain %s has no snapshots", chainPath)
+	}
+
+	layers := make([]string, len(chain.Snapshots))
+	for i, s := range chain.Snapshots {
+		if !filepath.IsAbs(s) {
+			s = filepath.Join(filepath.Dir(chainPath), s)
+		}
+		layers[i] = s
+		if err := requireFiles(s+".mem", s+".file"); err != nil {
+			return nil, err
+		}
+	}
+	return layers, nil
+}
+
+func writeChain(chainPath string, layers []string) error {
+	data, err := json.MarshalIndent(snapshotChain{Snapshots: layers}, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(chainPath, append(data, '\n'), 0644)
+}
+
+// Copy the data regions of a sparse file over dst. Diff snapshots leave
+// the pages that didn't change as holes.
+func overlaySparse(dst *os.File, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	for off := int64(0); ; {
+		start, err := f.Seek(off, seekData)
+		if err != nil {
+			// ENXIO: no data past off
+			return nil
+		}
+		end, err := f.Seek(start, seekHole)
+		if err != nil {
+			return err
+		}
+		if _, err := dst.Seek(start, io.SeekStart); err != nil {
+			return err
+		}
+		if _, err := copySnapshotData(dst, io.NewSectionReader(f, start, end-start)); err != nil {
+			return err
+		}
+		off = end
+	}
+}
+
+// Flatten the memory files of a chain into one.
+func mergeMemFiles(layers []string, memPath string) error {
+	out, err := os.Create(memPath)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	base, err := os.Open(layers[0] + ".mem")
+	if err != nil {
+		return err
+	}
+	_, err = copySnapshotData(out, base)
+	base.Close()
+	if err != nil {
+		return err
+	}
+
+	for _, layer := range layers[1:] {
+		if err := overlaySparse(out, layer+".mem"); err != nil {
+			return fmt.Errorf("failed to apply %s: %v", layer, err)
+		}
+	}
+	return out.Close()
+}
+
+func copyFile(src string, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := copySnapshotData(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// Disk space actually used by a snapshot, sparse memory files included.
+func snapshotDiskUsage(snapshotPath string) int64 {
+	var total int64
+	for _, ext := range []string{".mem", ".file", ".json"} {
+		if used, err := allocatedSize(snapshotPath + ext); err == nil {
+			total += used
+		}
+	}
+	return total
+}
+
+// Replace the diff snapshot chain in chainPath with a single full snapshot.
+// The chain is merged and restored into a VMM on socketPath, which takes
+// the new base snapshot under a temporary name. The old snapshots and chain
+// file are moved to a backup directory next to the chain only once that
+// worked, then the new base takes its place. A chain compacted before has
+// the old base as its first layer, so the two never share files.
+func compactChain(chainPath string, socketPath string, opts vmOptions) {
+	layers, err := readChain(chainPath)
+	if err != nil {
+		panic(err)
+	}
+
+	// The merged chain, as a restorable snapshot
+	merged := strings.TrimSuffix(chainPath, ".json") + "-merged"
+	registerSnapshot(merged)
+	defer os.Remove(merged + ".mem")
+	defer os.Remove(merged + ".file")
+
+	start := time.Now()
+	if err := mergeMemFiles(layers, merged+".mem"); err != nil {
+		panic(fmt.Errorf("failed to merge chain: %v", err))
+	}
+	if err := copyFile(layers[len(layers)-1]+".file", merged+".file"); err != nil {
+		panic(err)
+	}
+	mergeTime := time.Since(start)
+
+	base := strings.TrimSuffix(chainPath, ".json") + "-base"
+	pending := fmt.Sprintf("%s.compacting-%d", base, os.Getpid())
+	registerSnapshot(pending)
+	defer os.Remove(pending + ".mem")
+	defer os.Remove(pending + ".file")
+	defer os.Remove(manifestPath(pending))
+
+	vm := restoreVM(socketPath, merged, opts)
+	err = fullSnapshot(context.Background(), vm.machine, pending)
+	if err == nil {
+		var manifest *snapshotManifest
+		if manifest, err = newManifest(socketPath, pending, "Full"); err == nil {
+			err = writeManifest(pending, manifest)
+		}
+	}
+	vm.stop()
+	if err != nil {
+		panic(fmt.Errorf("failed to snapshot the restored chain, the chain is unchanged: %v", err))
+	}
+
+	backup := fmt.Sprintf("%s.bak-%s", chainPath, time.Now().UTC().Format("20060102T150405"))
+	if err := os.Mkdir(backup, 0755); err != nil {
+		panic(err)
+	}
+	var before int64
+	for _, layer := range layers {
+		before += snapshotDiskUsage(layer)
+		for _, ext := range []string{".mem", ".file", ".json"} {
+			err := os.Rename(layer+ext, filepath.Join(backup, filepath.Base(layer)+ext))
+			if err != nil && !os.IsNotExist(err) {
+				panic(fmt.Errorf("failed to back up %s: %v", layer, err))
+			}
+		}
+	}
+	if err := copyFile(chainPath, filepath.Join(backup, filepath.Base(chainPath))); err != nil {
+		panic(err)
+	}
+	for _, ext := range []string{".mem", ".file", ".json"} {
+		if err := os.Rename(pending+ext, base+ext); err != nil {
+			panic(fmt.Errorf("failed to move the new base into place, the old chain is in %s: %v", backup, err))
+		}
+	}
+	if err := writeChain(chainPath, []string{base}); err != nil {
+		panic(err)
+	}
+	log.Infof("Chain backed up to %s", backup)
+
+	after := snapshotDiskUsage(base)
+	fmt.Printf("Compacted %d snapshots into %s\n", len(layers), base)
+	fmt.Printf("Disk usage: %d MiB -> %d MiB\n", before>>20, after>>20)
+	fmt.Printf("Restores no longer need to merge %d layers, which took %v\n", len(layers), mergeTime)
+}
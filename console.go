@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"sync"
+)
+
+// Console lines kept around to give context, e.g. on a guest panic
+const consoleContextLines = 40
+
+type consolePattern struct {
+	pattern string
+	seen    chan struct{}
+}
+
+// Console lines starting with prefix, collected until the capture ends
+type consoleCapture struct {
+	prefix string
+	lines  []string
+}
+
+// Passes the guest console through while watching it for patterns.
+type consoleWatcher struct {
+	out io.Writer
+
+	mu       sync.Mutex
+	partial  []byte
+	lines    []string
+	patterns []consolePattern
+	captures []*consoleCapture
+}
+
+func newConsoleWatcher(out io.Writer) *consoleWatcher {
+	return &consoleWatcher{out: out}
+}
+
+// Return a channel that is closed once a console line containing pattern
+// is written after this call.
+func (w *consoleWatcher) watch(pattern string) <-chan struct{} {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	seen := make(chan struct{})
+	w.patterns = append(w.patterns, consolePattern{pattern, seen})
+	return seen
+}
+
+func (w *consoleWatcher) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	w.partial = append(w.partial, p...)
+	for {
+		i := bytes.IndexByte(w.partial, '\n')
+		if i < 0 {
+			break
+		}
+		line := strings.TrimRight(string(w.partial[:i]), "\r")
+		w.partial = w.partial[i+1:]
+
+		w.lines = append(w.lines, line)
+		if len(w.lines) > consoleContextLines {
+			w.lines = w.lines[1:]
+		}
+
+		pending := w.patterns[:0]
+		for _, p := range w.patterns {
+			if strings.Contains(line, p.pattern) {
+				close(p.seen)
+			} else {
+				pending = append(pending, p)
+			}
+		}
+		w.patterns = pending
+
+		for _, c := range w.captures {
+			if i := strings.Index(line, c.prefix); i >= 0 {
+				c.lines = append(c.lines, line[i+len(c.prefix):])
+			}
+		}
+	}
+	w.mu.Unlock()
+
+	return w.out.Write(p)
+}
+
+// Start collecting the console lines containing prefix, with everything up
+// to the prefix cut off.
+func (w *consoleWatcher) capture(prefix string) *consoleCapture {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	c := &consoleCapture{prefix: prefix}
+	w.captures = append(w.captures, c)
+	return c
+}
+
+// Stop a capture and return the lines it collected.
+func (w *consoleWatcher) endCapture(c *consoleCapture) []string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for i, other := range w.captures {
+		if other == c {
+			w.captures = append(w.captures[:i], w.captures[i+1:]...)
+			break
+		}
+	}
+	return c.lines
+}
+
+// The last console lines seen.
+func (w *consoleWatcher) context() []string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return append([]string(nil), w.lines...)
+}
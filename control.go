@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Readiness of a pool VM, as reported to load balancers
+const (
+	stateRestoring = "restoring"
+	// Passed the guest-ready probe, can take traffic
+	stateReady = "ready"
+	// Paused or being stopped
+	stateDraining = "draining"
+)
+
+// The state of the VMs of a pool, by name. The methods of a nil vmStates
+// do nothing.
+type vmStates struct {
+	mu     sync.Mutex
+	states map[string]string
+}
+
+func newVMStates() *vmStates {
+	return &vmStates{states: map[string]string{}}
+}
+
+func (s *vmStates) set(name string, state string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.states[name] = state
+}
+
+func (s *vmStates) remove(name string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.states, name)
+}
+
+func (s *vmStates) get(name string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	state, ok := s.states[name]
+	return state, ok
+}
+
+// One entry of /vms
+type vmStatus struct {
+	Name  string `json:"name"`
+	State string `json:"state"`
+}
+
+func (s *vmStates) list() []vmStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := []vmStatus{}
+	for name, state := range s.states {
+		list = append(list, vmStatus{Name: name, State: state})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// Serve the VM states over HTTP on addr: /vms lists them as JSON and
+// /ready/<name> answers 200 only while that VM is ready, for load balancer
+// health checks.
+func serveControl(addr string, states *vmStates) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/vms", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(states.list())
+	})
+	mux.HandleFunc("/ready/", func(w http.ResponseWriter, r *http.Request) {
+		state, ok := states.get(strings.TrimPrefix(r.URL.Path, "/ready/"))
+		switch {
+		case !ok:
+			http.NotFound(w, r)
+		case state != stateReady:
+			http.Error(w, state, http.StatusServiceUnavailable)
+		default:
+			w.Write([]byte(state + "\n"))
+		}
+	})
+
+	go func() {
+		if err := http.Serve(l, mux); err != nil {
+			log.Errorf("control server stopped: %v", err)
+		}
+	}()
+	log.Infof("Serving VM states on http://%s/vms", l.Addr())
+	return nil
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Host memory of a VMM process, from /proc/<pid>/smaps_rollup, in KiB
+type vmmMemory struct {
+	Rss int64
+	// Proportional share: private pages plus shared ones divided among the
+	// processes sharing them
+	Pss     int64
+	Shared  int64
+	Private int64
+}
+
+func readVMMMemory(pid int) (*vmmMemory, error) {
+	data, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/smaps_rollup", pid))
+	if err != nil {
+		return nil, err
+	}
+	m := &vmmMemory{}
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		kib, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		switch fields[0] {
+		case "Rss:":
+			m.Rss = kib
+		case "Pss:":
+			m.Pss = kib
+		case "Shared_Clean:", "Shared_Dirty:":
+			m.Shared += kib
+		case "Private_Clean:", "Private_Dirty:":
+			m.Private += kib
+		}
+	}
+	return m, nil
+}
+
+// A clone of the -density-test
+type densityClone struct {
+	vm     *restoredVM
+	socket string
+}
+
+// Restore n clones of snapshotPath, each VMM in its own directory next to
+// socketPath, let them run for settle and print how much host memory each
+// takes and how many such VMs fit in a GiB. Firecracker maps the memory
+// file privately, so the guest pages no clone wrote to stay shared in the
+// host page cache. Clones that fail to restore are reported and the others
+// measured. Returns the exit code.
+func densityTest(socketPath string, snapshotPath string, n int, settle time.Duration, opts vmOptions) int {
+	opts.detached = true
+	dir := socketPath + ".density"
+	registerPath("density test directory", dir)
+	defer os.RemoveAll(dir)
+
+	var clones []densityClone
+	defer func() {
+		for _, c := range clones {
+			c.vm.stop()
+		}
+	}()
+
+	failed := 0
+	restore := func(i int) (c densityClone, err error) {
+		// restoreVM panics on failure, after cleaning up
+		defer func() {
+			if p := recover(); p != nil {
+				err = fmt.Errorf("%v", p)
+			}
+		}()
+		cloneDir := filepath.Join(dir, strconv.Itoa(i))
+		if err := os.MkdirAll(cloneDir, 0755); err != nil {
+			return c, err
+		}
+		opts.workDir = cloneDir
+		c.socket = filepath.Join(cloneDir, "api.sock")
+		c.vm = restoreVM(c.socket, snapshotPath, opts)
+		if err := resumeRestored(c.vm, opts); err != nil {
+			c.vm.stop()
+			return c, err
+		}
+		return c, nil
+	}
+	for i := 0; i < n; i++ {
+		c, err := restore(i)
+		if err != nil {
+			log.Errorf("Clone %d failed to restore: %v", i, err)
+			failed++
+			continue
+		}
+		clones = append(clones, c)
+	}
+	summary.value("clones_requested", float64(n))
+	summary.value("clones_restored", float64(len(clones)))
+	if len(clones) == 0 {
+		log.Errorf("No clone restored")
+		return exitFailure
+	}
+
+	log.Infof("Letting %d clones run for %v", len(clones), settle)
+	time.Sleep(settle)
+
+	fmt.Printf("%-6s %10s %10s %10s %10s\n", "clone", "rss_mib", "pss_mib", "shared_mib", "private_mib")
+	var total vmmMemory
+	measured := 0
+	for i, c := range clones {
+		pid, err := findVMMPid(c.socket)
+		var m *vmmMemory
+		if err == nil {
+			m, err = readVMMMemory(pid)
+		}
+		if err != nil {
+			log.Errorf("Clone %d can't be measured: %v", i, err)
+			failed++
+			continue
+		}
+		measured++
+		total.Rss += m.Rss
+		total.Pss += m.Pss
+		total.Shared += m.Shared
+		total.Private += m.Private
+		fmt.Printf("%-6d %10d %10d %10d %10d\n", i, m.Rss>>10, m.Pss>>10, m.Shared>>10, m.Private>>10)
+	}
+	if measured == 0 {
+		return exitFailure
+	}
+
+	// kib per VM to VMs per GiB
+	perGiB := func(kib int64) float64 {
+		return float64(measured) * (1 << 20) / float64(kib)
+	}
+	fmt.Printf("Clones: %d measured, %d failed\n", measured, failed)
+	fmt.Printf("Host memory: %d MiB in total (PSS), %d MiB without sharing (RSS)\n", total.Pss>>10, total.Rss>>10)
+	fmt.Printf("Density: %.1f VMs per GiB, %.1f without sharing\n", perGiB(total.Pss), perGiB(total.Rss))
+	summary.value("clones_measured", float64(measured))
+	summary.value("vms_per_gib", perGiB(total.Pss))
+	summary.value("vms_per_gib_unshared", perGiB(total.Rss))
+	summary.size("pss_total", total.Pss<<10)
+	summary.size("rss_total", total.Rss<<10)
+
+	if failed != 0 {
+		return exitFailure
+	}
+	return exitOK
+}
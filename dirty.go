@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	firecracker "github.com/firecracker-microvm/firecracker-go-sdk"
+	ops "github.com/firecracker-microvm/firecracker-go-sdk/client/operations"
+)
+
+// MMDS key the guest agent polls for requests to dirty memory
+const dirtyMemKey = "dirty_mem"
+
+// Have the guest agent of the VM behind socketPath dirty ratio of the guest
+// memory, giving it wait to do so, and take a diff snapshot to snapshotPath.
+// The diff size is printed next to the amount dirtied.
+func dirtyAndSnapshot(socketPath string, snapshotPath string, ratio float64, wait time.Duration) {
+	ctx := context.Background()
+	cfg := firecracker.Config{SocketPath: socketPath}
+	machine, err := firecracker.NewMachine(ctx, cfg, firecracker.WithClient(newAPIClient(cfg.SocketPath)),
+		firecracker.WithLogger(log.NewEntry(log.New())))
+	if err != nil {
+		panic(fmt.Errorf("failed to create new machine: %v", err))
+	}
+
+	resp, err := newAPIClient(socketPath).GetMachineConfiguration()
+	if err != nil {
+		panic(fmt.Errorf("failed to get machine configuration: %v", err))
+	}
+	memBytes := *resp.Payload.MemSizeMib << 20
+	dirty := int64(float64(memBytes)*ratio) / pageSize * pageSize
+
+	// A throwaway diff resets the dirty page tracking, so that the real one
+	// only holds what was dirtied since
+	baseline := socketPath + ".dirty-baseline"
+	registerSnapshot(baseline)
+	defer os.Remove(baseline + ".mem")
+	defer os.Remove(baseline + ".file")
+	if err := pauseWithRetry(ctx, machine); err != nil {
+		panic(err)
+	}
+	err = machine.CreateSnapshot(ctx, baseline+".mem", baseline+".file",
+		func(data *ops.CreateSnapshotParams) {
+			data.Body.SnapshotType = "Diff"
+		})
+	machine.ResumeVM(ctx)
+	recordEvent("resume", socketPath, "")
+	if err != nil {
+		panic(fmt.Errorf("failed to create baseline snapshot: %v", err))
+	}
+
+	request := newGuestRequest(machine, dirtyMemKey, nil)
+	if err := request.set(ctx, map[string]interface{}{"bytes": dirty}); err != nil {
+		panic(fmt.Errorf("failed to ask the guest to dirty memory: %v", err))
+	}
+	request.wait(wait)
+
+	createSnapshot(socketPath, snapshotPath)
+	size, err := allocatedSize(snapshotPath + ".mem")
+	if err != nil {
+		panic(err)
+	}
+	fmt.Printf("Dirtied:   %d MiB (%.0f%% of %d MiB)\n", dirty>>20, ratio*100, memBytes>>20)
+	fmt.Printf("Diff size: %d MiB (%.2fx the dirtied memory)\n", size>>20, float64(size)/float64(dirty))
+}
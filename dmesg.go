@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	firecracker "github.com/firecracker-microvm/firecracker-go-sdk"
+)
+
+// Whether the guest dmesg is captured before snapshots and after restores,
+// set by -capture-dmesg
+var captureDmesg bool
+
+// MMDS key the guest agent polls for dmesg requests
+const dmesgKey = "dmesg"
+
+// How long the guest agent gets to print its dmesg
+const dmesgTimeout = 10 * time.Second
+
+// Where the dmesg captured before and after a snapshot go
+func dmesgPath(snapshotPath string) string {
+	return snapshotPath + ".dmesg"
+}
+
+func restoredDmesgPath(snapshotPath string) string {
+	return snapshotPath + ".restored.dmesg"
+}
+
+// Ask the guest agent for its dmesg, which it prints on the console as
+// "dmesg <id> <line>" lines followed by "dmesg done <id>". A restored VM
+// starts with an empty data store unless storeSet, so the request replaces
+// it then.
+func readGuestDmesg(machine *firecracker.Machine, console *consoleWatcher, storeSet bool) ([]string, error) {
+	if console == nil {
+		return nil, fmt.Errorf("guest console not available")
+	}
+	ctx := context.Background()
+	request := newGuestRequest(machine, dmesgKey, console)
+	request.replace = !storeSet
+	capture := console.capture(dmesgKey + " " + request.id + " ")
+
+	if err := request.set(ctx, map[string]interface{}{}); err != nil {
+		console.endCapture(capture)
+		return nil, fmt.Errorf("failed to ask the guest for its dmesg: %v", err)
+	}
+	done := request.wait(dmesgTimeout)
+	lines := console.endCapture(capture)
+	if !done {
+		return nil, fmt.Errorf("guest dmesg not done after %v", dmesgTimeout)
+	}
+	return lines, nil
+}
+
+func writeLines(path string, lines []string) error {
+	return ioutil.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0644)
+}
+
+// Save the dmesg of the VM behind socketPath next to the snapshot about to
+// be taken to snapshotPath.
+func dmesgBeforeSnapshot(socketPath string, snapshotPath string, console *consoleWatcher) error {
+	ctx := context.Background()
+	cfg := firecracker.Config{SocketPath: socketPath}
+	machine, err := firecracker.NewMachine(ctx, cfg, firecracker.WithClient(newAPIClient(cfg.SocketPath)),
+		firecracker.WithLogger(log.NewEntry(log.New())))
+	if err != nil {
+		return fmt.Errorf("failed to create new machine: %v", err)
+	}
+
+	lines, err := readGuestDmesg(machine, console, true)
+	if err != nil {
+		return err
+	}
+	path := dmesgPath(snapshotPath)
+	if err := writeLines(path, lines); err != nil {
+		return err
+	}
+	log.Infof("Saved %d guest dmesg lines to %s", len(lines), path)
+	return nil
+}
+
+// Save the dmesg of a resumed VM and print the kernel messages that weren't
+// in the one saved with its snapshot.
+func dmesgAfterRestore(vm *restoredVM, opts vmOptions) error {
+	lines, err := readGuestDmesg(vm.machine, vm.console, opts.metadata != nil)
+	if err != nil {
+		return err
+	}
+	path := restoredDmesgPath(vm.snapshotPath)
+	if err := writeLines(path, lines); err != nil {
+		return err
+	}
+	log.Infof("Saved %d guest dmesg lines to %s", len(lines), path)
+
+	data, err := ioutil.ReadFile(dmesgPath(vm.snapshotPath))
+	if err != nil {
+		return fmt.Errorf("no dmesg saved with the snapshot: %v", err)
+	}
+	before := map[string]bool{}
+	for _, line := range strings.Split(string(data), "\n") {
+		before[line] = true
+	}
+	var added []string
+	for _, line := range lines {
+		if !before[line] {
+			added = append(added, line)
+		}
+	}
+
+	if len(added) == 0 {
+		fmt.Println("No new guest kernel messages since the snapshot")
+		return nil
+	}
+	fmt.Println("Guest kernel messages since the snapshot:")
+	for _, line := range added {
+		fmt.Println("+", line)
+	}
+	return nil
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// One line of the -event-log file
+type lifecycleEvent struct {
+	Time time.Time `json:"time"`
+	// start, pause, resume, snapshot, restore, stop or crash
+	Event string `json:"event"`
+	// The VM, by API socket
+	Socket   string `json:"socket"`
+	Snapshot string `json:"snapshot,omitempty"`
+	Pid      int    `json:"launcher_pid"`
+}
+
+var (
+	eventLog   *os.File
+	eventLogMu sync.Mutex
+)
+
+func openEventLog(path string) error {
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		registerPath("event log", path)
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	eventLog = f
+	return nil
+}
+
+// Append a lifecycle event to the event log, if there is one. Each event is
+// synced to disk before returning so a crash loses nothing already recorded.
+func recordEvent(event string, socketPath string, snapshotPath string) {
+	if eventLog == nil {
+		return
+	}
+	data, err := json.Marshal(lifecycleEvent{
+		Time:     time.Now().UTC(),
+		Event:    event,
+		Socket:   socketPath,
+		Snapshot: snapshotPath,
+		Pid:      os.Getpid(),
+	})
+	if err != nil {
+		return
+	}
+
+	eventLogMu.Lock()
+	defer eventLogMu.Unlock()
+	// A single write per line, O_APPEND keeps concurrent launchers apart
+	_, err = eventLog.Write(append(data, '\n'))
+	if err == nil {
+		err = eventLog.Sync()
+	}
+	if err != nil {
+		log.Errorf("failed to write event log: %v", err)
+	}
+}
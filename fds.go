@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+)
+
+// An open file descriptor of a process
+type fdEntry struct {
+	FD     int    `json:"fd"`
+	Target string `json:"target,omitempty"`
+	// Why the target couldn't be read
+	Error string `json:"error,omitempty"`
+}
+
+// List the open file descriptors of pid and what they point to.
+func listFDs(pid int) ([]fdEntry, error) {
+	dir := fmt.Sprintf("/proc/%d/fd", pid)
+	names, err := ioutil.ReadDir(dir)
+	if os.IsPermission(err) {
+		return nil, fmt.Errorf("no permission to read %s, run as the VMM's user or root", dir)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var fds []fdEntry
+	for _, name := range names {
+		fd, err := strconv.Atoi(name.Name())
+		if err != nil {
+			continue
+		}
+		entry := fdEntry{FD: fd}
+		// Closed between the listing and here, or not allowed
+		if entry.Target, err = os.Readlink(filepath.Join(dir, name.Name())); err != nil {
+			entry.Error = err.(*os.PathError).Err.Error()
+		}
+		fds = append(fds, entry)
+	}
+	sort.Slice(fds, func(i, j int) bool { return fds[i].FD < fds[j].FD })
+	return fds, nil
+}
+
+// Print the open file descriptors of pid, as a table or as JSON.
+func printFDs(pid int, asJSON bool) error {
+	fds, err := listFDs(pid)
+	if err != nil {
+		return err
+	}
+
+	if asJSON {
+		out := json.NewEncoder(os.Stdout)
+		out.SetIndent("", "  ")
+		return out.Encode(struct {
+			Pid int       `json:"pid"`
+			FDs []fdEntry `json:"fds"`
+		}{pid, fds})
+	}
+
+	fmt.Printf("Open files of %d:\n", pid)
+	for _, fd := range fds {
+		if fd.Error != "" {
+			fmt.Printf("%5d  (%s)\n", fd.FD, fd.Error)
+			continue
+		}
+		fmt.Printf("%5d  %s\n", fd.FD, fd.Target)
+	}
+	return nil
+}
@@ -4,5 +4,6 @@ go 1.16
 
 require (
 	github.com/firecracker-microvm/firecracker-go-sdk v0.22.0
+	github.com/go-openapi/runtime v0.19.22
 	github.com/sirupsen/logrus v1.8.0
 )
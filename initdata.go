@@ -0,0 +1,40 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Build a config drive image holding the files of dir, for an in-guest
+// init to mount and apply at boot. The image is kept next to the socket so
+// that snapshots of the VM can still find it.
+func buildInitDrive(dir string, socketPath string) (string, error) {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return "", err
+	}
+	if !info.IsDir() {
+		return "", fmt.Errorf("%s is not a directory", dir)
+	}
+
+	var size int64
+	err = filepath.Walk(dir, func(_ string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		size += fi.Size()
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	image := socketPath + ".init.ext4"
+	registerPath("init data drive", image)
+	if err := buildExt4(dir, image, 2*size+8<<20); err != nil {
+		os.Remove(image)
+		return "", fmt.Errorf("failed to build init data drive: %v", err)
+	}
+	return image, nil
+}
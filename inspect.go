@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// Magic numbers at the start of Firecracker state files, the low 16 bits
+// hold the format version
+var stateMagics = map[uint64]string{
+	0x0710198486640000: "x86_64",
+	0x07101984AAAA0000: "aarch64",
+}
+
+// The only state file format version the header is known for
+const stateFormatVersion = 1
+
+// What the header of a state file tells
+type stateHeader struct {
+	arch          string
+	formatVersion uint16
+	// Version of the serialized VM state, tied to the Firecracker release
+	dataVersion uint16
+}
+
+func readStateHeader(path string) (*stateHeader, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var raw struct {
+		Magic       uint64
+		DataVersion uint16
+	}
+	if err := binary.Read(f, binary.LittleEndian, &raw); err == io.EOF || err == io.ErrUnexpectedEOF {
+		return nil, fmt.Errorf("%s is too short to be a state file", path)
+	} else if err != nil {
+		return nil, err
+	}
+
+	arch, ok := stateMagics[raw.Magic&^0xffff]
+	if !ok {
+		return nil, fmt.Errorf("%s: unrecognized state file magic %#x", path, raw.Magic)
+	}
+	hdr := &stateHeader{arch: arch, formatVersion: uint16(raw.Magic)}
+	if hdr.formatVersion != stateFormatVersion {
+		return hdr, fmt.Errorf("%s: unrecognized state file format version %d", path, hdr.formatVersion)
+	}
+	hdr.dataVersion = raw.DataVersion
+	return hdr, nil
+}
+
+// Print what can be told about a snapshot without restoring it: the header
+// of the state file, the memory file and the manifest. The VM state itself
+// is only readable by the Firecracker release that wrote it, so device
+// states are not decoded.
+func inspectSnapshot(snapshotPath string) error {
+	statePath := snapshotPath + ".file"
+	info, err := os.Stat(statePath)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("State file:      %s (%d bytes)\n", statePath, info.Size())
+
+	hdr, err := readStateHeader(statePath)
+	if hdr == nil {
+		return err
+	}
+	fmt.Printf("Architecture:    %s\n", hdr.arch)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Format version:  %d\n", hdr.formatVersion)
+	fmt.Printf("Data version:    %d\n", hdr.dataVersion)
+
+	if info, err := os.Stat(snapshotPath + ".mem"); err == nil {
+		used, _ := allocatedSize(snapshotPath + ".mem")
+		fmt.Printf("Memory file:     %d MiB, %d MiB on disk\n", info.Size()>>20, used>>20)
+	} else {
+		fmt.Printf("Memory file:     %v\n", err)
+	}
+
+	m, err := readManifest(snapshotPath)
+	if err != nil {
+		return err
+	}
+	if m == nil {
+		fmt.Println("Manifest:        none, vCPUs and memory size unknown")
+		return nil
+	}
+	fmt.Printf("vCPUs:           %d\n", m.VcpuCount)
+	fmt.Printf("Memory size:     %d MiB\n", m.MemSizeMib)
+	fmt.Printf("Snapshot type:   %s\n", m.SnapshotType)
+	fmt.Printf("Created:         %s\n", m.CreatedAt)
+	if m.Host != nil {
+		host := []string{m.Host.CPUModel, m.Host.KernelVersion, m.Host.FirecrackerVersion}
+		fmt.Printf("Host:            %s\n", strings.Join(host, ", "))
+	}
+	return nil
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// Strings that don't need quoting in a shell
+var shellSafeRe = regexp.MustCompile(`^[A-Za-z0-9_@%+=:,./-]+$`)
+
+func shellQuote(s string) string {
+	if shellSafeRe.MatchString(s) {
+		return s
+	}
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// A resolved flag and where its value came from
+type invocationFlag struct {
+	Value interface{} `json:"value"`
+	// "command line" or "default", the launcher reads no environment
+	// variables or config files
+	Source string `json:"source"`
+}
+
+// Print the resolved flags as a command line that reproduces this run and
+// as JSON. Paths are printed as resolved against the working directory.
+func printInvocation() {
+	set := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) { set[f.Name] = true })
+
+	cmdline := []string{shellQuote(os.Args[0])}
+	flags := map[string]invocationFlag{}
+	flag.VisitAll(func(f *flag.Flag) {
+		source := "default"
+		if set[f.Name] {
+			source = "command line"
+		}
+
+		// Repeated flags are repeated on the command line
+		if list, ok := f.Value.(*stringList); ok {
+			flags[f.Name] = invocationFlag{Value: []string(*list), Source: source}
+			for _, value := range *list {
+				cmdline = append(cmdline, "-"+f.Name+"="+shellQuote(value))
+			}
+			return
+		}
+
+		value := f.Value.String()
+		flags[f.Name] = invocationFlag{Value: value, Source: source}
+		if value != f.DefValue {
+			cmdline = append(cmdline, "-"+f.Name+"="+shellQuote(value))
+		}
+	})
+
+	fmt.Println("Invocation:", strings.Join(cmdline, " "))
+	data, _ := json.MarshalIndent(flags, "", "  ")
+	fmt.Println(string(data))
+}
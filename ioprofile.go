@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	firecracker "github.com/firecracker-microvm/firecracker-go-sdk"
+	models "github.com/firecracker-microvm/firecracker-go-sdk/client/models"
+)
+
+// Drive throttling of an -io-profile, per second
+type ioProfile struct {
+	bytes int64
+	ops   int64
+}
+
+// The -io-profile names, documented in the README
+var ioProfiles = map[string]ioProfile{
+	"ssd":       {bytes: 500 << 20, ops: 50000},
+	"hdd":       {bytes: 150 << 20, ops: 200},
+	"network":   {bytes: 100 << 20, ops: 3000},
+	"throttled": {bytes: 10 << 20, ops: 100},
+}
+
+// A bucket refilled with perSecond tokens every second
+func tokenBucket(perSecond int64) models.TokenBucket {
+	return models.TokenBucket{
+		Size:       firecracker.Int64(perSecond),
+		RefillTime: firecracker.Int64(1000),
+	}
+}
+
+// Resolve an -io-profile name to the rate limiter of its drives.
+func ioRateLimiter(name string) (*models.RateLimiter, error) {
+	p, ok := ioProfiles[name]
+	if !ok {
+		var names []string
+		for n := range ioProfiles {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("unknown I/O profile %q, expected one of %s", name, strings.Join(names, ", "))
+	}
+	return firecracker.NewRateLimiter(tokenBucket(p.bytes), tokenBucket(p.ops)), nil
+}
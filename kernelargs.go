@@ -0,0 +1,275 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Module names as accepted by modprobe: letters, digits, '_' and '-'.
+var moduleNameRe = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// Split a kernel command line into its whitespace separated tokens.
+func splitKernelArgs(args string) []string {
+	return strings.Fields(args)
+}
+
+// Return the value of the first key=value token matching key.
+func kernelArgValue(tokens []string, key string) (string, bool) {
+	for _, tok := range tokens {
+		kv := strings.SplitN(tok, "=", 2)
+		if len(kv) == 2 && kv[0] == key {
+			return kv[1], true
+		}
+	}
+	return "", false
+}
+
+// Return the values of every key=value token matching key, in order.
+func kernelArgValues(tokens []string, key string) []string {
+	var values []string
+	for _, tok := range tokens {
+		kv := strings.SplitN(tok, "=", 2)
+		if len(kv) == 2 && kv[0] == key {
+			values = append(values, kv[1])
+		}
+	}
+	return values
+}
+
+// Set key=value in the token list, replacing any existing occurrences of key.
+// The first occurrence keeps its position, new keys are appended.
+func setKernelArg(tokens []string, key string, value string) []string {
+	tok := key
+	if value != "" {
+		tok = key + "=" + value
+	}
+
+	out := make([]string, 0, len(tokens)+1)
+	replaced := false
+	for _, t := range tokens {
+		if strings.SplitN(t, "=", 2)[0] != key {
+			out = append(out, t)
+			continue
+		}
+		if !replaced {
+			out = append(out, tok)
+			replaced = true
+		}
+	}
+	if !replaced {
+		out = append(out, tok)
+	}
+	return out
+}
+
+// Parse a comma separated list of module names, validating each of them.
+func parseModuleList(list string) ([]string, error) {
+	var modules []string
+	for _, name := range strings.Split(list, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if !moduleNameRe.MatchString(name) {
+			return nil, fmt.Errorf("invalid module name %q", name)
+		}
+		modules = append(modules, name)
+	}
+	return modules, nil
+}
+
+// Add the given modules to the modprobe.blacklist= kernel argument.
+// Modules already blocked by the existing arguments are not repeated, those
+// of repeated modprobe.blacklist= arguments are merged into one.
+// Returns the new kernel arguments and the resulting blocklist.
+func withModuleBlocklist(args string, list string) (string, []string, error) {
+	modules, err := parseModuleList(list)
+	if err != nil {
+		return "", nil, err
+	}
+
+	tokens := splitKernelArgs(args)
+	var blocklist []string
+	seen := map[string]bool{}
+	var existing []string
+	for _, value := range kernelArgValues(tokens, "modprobe.blacklist") {
+		existing = append(existing, strings.Split(value, ",")...)
+	}
+	modules = append(existing, modules...)
+	for _, name := range modules {
+		if name == "" || seen[name] {
+			continue
+		}
+		seen[name] = true
+		blocklist = append(blocklist, name)
+	}
+
+	if len(blocklist) == 0 {
+		return args, nil, nil
+	}
+
+	tokens = setKernelArg(tokens, "modprobe.blacklist", strings.Join(blocklist, ","))
+	return strings.Join(tokens, " "), blocklist, nil
+}
+
+// Clocksources a Firecracker guest can use
+var clocksources = []string{"kvm-clock", "tsc", "jiffies", "arch_sys_counter"}
+
+// Select the guest clocksource. With tsc the kernel is also told to trust
+// it, otherwise its watchdog can switch away from it after a restore.
+func withClocksource(args string, clocksource string) (string, error) {
+	valid := false
+	for _, c := range clocksources {
+		valid = valid || c == clocksource
+	}
+	if !valid {
+		return "", fmt.Errorf("unknown clocksource %q, expected one of %s",
+			clocksource, strings.Join(clocksources, ", "))
+	}
+
+	tokens := setKernelArg(splitKernelArgs(args), "clocksource", clocksource)
+	if clocksource == "tsc" {
+		tokens = setKernelArg(tokens, "tsc", "reliable")
+	}
+	return strings.Join(tokens, " "), nil
+}
+
+// Run the given guest binary as PID 1.
+func withInit(args string, initPath string) (string, error) {
+	if !strings.HasPrefix(initPath, "/") {
+		return "", fmt.Errorf("init must be an absolute path in the guest, got %q", initPath)
+	}
+
+	tokens := splitKernelArgs(args)
+	// With an initrd, rdinit= picks what runs first and init= only applies
+	// after it switches root, which is rarely what's intended here
+	if _, ok := kernelArgValue(tokens, "rdinit"); ok {
+		return "", fmt.Errorf("init conflicts with the initrd setup done by rdinit=")
+	}
+
+	return strings.Join(setKernelArg(tokens, "init", initPath), " "), nil
+}
+
+// Kernel parameter names: letters, digits, '_', '-' and '.' for module
+// parameters
+var kernelArgKeyRe = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+// Merge key[=value] tokens into the kernel arguments, replacing existing
+// values of the same keys.
+func withKernelArgs(args string, overrides []string) (string, error) {
+	tokens := splitKernelArgs(args)
+	for _, tok := range overrides {
+		kv := strings.SplitN(tok, "=", 2)
+		if !kernelArgKeyRe.MatchString(kv[0]) {
+			return "", fmt.Errorf("invalid kernel argument %q: bad name", tok)
+		}
+		value := ""
+		if len(kv) == 2 {
+			value = kv[1]
+			if value == "" || strings.ContainsAny(value, " \t\n\"") {
+				return "", fmt.Errorf("invalid kernel argument %q: bad value", tok)
+			}
+		}
+		tokens = setKernelArg(tokens, kv[0], value)
+	}
+	return strings.Join(tokens, " "), nil
+}
+
+// A flag that can be given several times
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, " ")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// Options accepted by -rootflags without a value, the common ext4 ones
+var rootflagNames = map[string]bool{
+	"barrier": true, "nobarrier": true, "discard": true, "nodiscard": true,
+	"noload": true, "norecovery": true, "journal_checksum": true,
+	"nojournal_checksum": true, "journal_async_commit": true,
+	"user_xattr": true, "nouser_xattr": true, "acl": true, "noacl": true,
+	"delalloc": true, "nodelalloc": true, "auto_da_alloc": true,
+	"noauto_da_alloc": true, "init_itable": true, "noinit_itable": true,
+	"dax": true, "lazytime": true, "nolazytime": true, "sync": true,
+	"async": true, "dirsync": true,
+}
+
+// Options accepted by -rootflags with a value
+var rootflagValues = map[string]*regexp.Regexp{
+	"data":    regexp.MustCompile(`^(journal|ordered|writeback)$`),
+	"errors":  regexp.MustCompile(`^(continue|remount-ro|panic)$`),
+	"commit":  regexp.MustCompile(`^[0-9]+$`),
+	"barrier": regexp.MustCompile(`^[01]$`),
+}
+
+// Per-mount options the kernel refuses in rootflags=
+var mountOnlyFlags = map[string]bool{
+	"noatime": true, "atime": true, "relatime": true, "norelatime": true,
+	"strictatime": true, "nostrictatime": true, "nodiratime": true,
+	"diratime": true, "nodev": true, "noexec": true, "nosuid": true,
+}
+
+// Merge comma separated root filesystem options into the rootflags= kernel
+// argument, replacing existing values of the same options. ro and rw go to
+// the kernel's own ro/rw arguments instead. Returns the new kernel
+// arguments and the resulting rootflags.
+func withRootflags(args string, flags string) (string, string, error) {
+	tokens := splitKernelArgs(args)
+	var opts []string
+	if existing, ok := kernelArgValue(tokens, "rootflags"); ok {
+		opts = strings.Split(existing, ",")
+	}
+
+	for _, opt := range strings.Split(flags, ",") {
+		opt = strings.TrimSpace(opt)
+		kv := strings.SplitN(opt, "=", 2)
+		switch {
+		case opt == "":
+			continue
+		case opt == "ro" || opt == "rw":
+			other := map[string]string{"ro": "rw", "rw": "ro"}[opt]
+			kept := tokens[:0]
+			for _, t := range tokens {
+				if t != other {
+					kept = append(kept, t)
+				}
+			}
+			tokens = setKernelArg(kept, opt, "")
+			continue
+		case mountOnlyFlags[opt]:
+			return "", "", fmt.Errorf("invalid root filesystem option %q: the kernel only takes it as a mount flag, remount / in the guest instead", opt)
+		case len(kv) == 2:
+			re, ok := rootflagValues[kv[0]]
+			if !ok || !re.MatchString(kv[1]) {
+				return "", "", fmt.Errorf("invalid root filesystem option %q", opt)
+			}
+		case !rootflagNames[opt]:
+			return "", "", fmt.Errorf("unknown root filesystem option %q", opt)
+		}
+
+		// Replace the existing value of the option
+		key := kv[0]
+		replaced := false
+		for i, o := range opts {
+			if strings.SplitN(o, "=", 2)[0] == key {
+				opts[i] = opt
+				replaced = true
+			}
+		}
+		if !replaced {
+			opts = append(opts, opt)
+		}
+	}
+
+	rootflags := strings.Join(opts, ",")
+	if rootflags != "" {
+		tokens = setKernelArg(tokens, "rootflags", rootflags)
+	}
+	return strings.Join(tokens, " "), rootflags, nil
+}
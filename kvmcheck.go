@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+)
+
+// ioctls on /dev/kvm, from linux/kvm.h
+const (
+	kvmGetAPIVersion  = 0xae00
+	kvmCheckExtension = 0xae03
+	// The only KVM API version there is
+	kvmAPIVersion = 12
+)
+
+// A KVM capability snapshot/restore relies on
+type kvmCap struct {
+	name string
+	id   uintptr
+	// What it's needed for
+	use string
+	// Missing optional capabilities only limit which snapshots work
+	optional bool
+}
+
+// Capabilities by architecture, from linux/kvm.h
+var kvmCaps = map[string][]kvmCap{
+	"amd64": {
+		{"KVM_CAP_SYNC_MMU", 16, "guest memory backed by the memory file", false},
+		{"KVM_CAP_IRQCHIP", 0, "saving and restoring the interrupt controllers", false},
+		{"KVM_CAP_PIT_STATE2", 35, "saving and restoring the PIT", false},
+		{"KVM_CAP_MP_STATE", 14, "saving and restoring vCPU run states", false},
+		{"KVM_CAP_VCPU_EVENTS", 41, "saving and restoring pending vCPU exceptions and interrupts", false},
+		{"KVM_CAP_DEBUGREGS", 50, "saving and restoring debug registers", false},
+		{"KVM_CAP_XSAVE", 55, "saving and restoring FPU and vector state", false},
+		{"KVM_CAP_XCRS", 56, "saving and restoring extended control registers", false},
+		{"KVM_CAP_ADJUST_CLOCK", 39, "restoring the kvm-clock", false},
+		{"KVM_CAP_GET_TSC_KHZ", 61, "recording the TSC frequency in the snapshot", false},
+		{"KVM_CAP_TSC_CONTROL", 60, "restoring snapshots taken on hosts with another TSC frequency", true},
+		{"KVM_CAP_MANUAL_DIRTY_LOG_PROTECT2", 168, "cheaper dirty page tracking for diff snapshots", true},
+	},
+	"arm64": {
+		{"KVM_CAP_SYNC_MMU", 16, "guest memory backed by the memory file", false},
+		{"KVM_CAP_ONE_REG", 70, "saving and restoring vCPU registers", false},
+		{"KVM_CAP_DEVICE_CTRL", 89, "saving and restoring the GIC", false},
+		{"KVM_CAP_MP_STATE", 14, "saving and restoring vCPU run states", false},
+		{"KVM_CAP_MANUAL_DIRTY_LOG_PROTECT2", 168, "cheaper dirty page tracking for diff snapshots", true},
+	},
+}
+
+// Probe /dev/kvm for the capabilities snapshot/restore needs and print
+// which are present. Returns the names of the missing required ones.
+func checkSnapshotSupport() ([]string, error) {
+	caps, ok := kvmCaps[runtime.GOARCH]
+	if !ok {
+		return nil, fmt.Errorf("no known snapshot requirements for %s", runtime.GOARCH)
+	}
+
+	kvm, err := os.OpenFile("/dev/kvm", os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer kvm.Close()
+
+	version, err := ioctlValue(kvm.Fd(), kvmGetAPIVersion, 0)
+	if err != nil {
+		return nil, fmt.Errorf("KVM_GET_API_VERSION: %v", err)
+	}
+	if version != kvmAPIVersion {
+		return nil, fmt.Errorf("KVM API version is %d, expected %d", version, kvmAPIVersion)
+	}
+
+	var missing []string
+	for _, c := range caps {
+		present, err := ioctlValue(kvm.Fd(), kvmCheckExtension, c.id)
+		status := "present"
+		switch {
+		case err == nil && present > 0:
+		case c.optional:
+			status = "missing (optional)"
+		default:
+			status = "MISSING"
+			missing = append(missing, c.name)
+		}
+		fmt.Printf("%-34s %-18s %s\n", c.name, status, c.use)
+	}
+	return missing, nil
+}
@@ -4,7 +4,11 @@ import (
 	"context"
 	"flag"
 	"fmt"
+	"net"
 	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
 	"time"
 
 	log "github.com/sirupsen/logrus"
@@ -22,25 +26,192 @@ const (
 	rootfsPath      = "rootfs.ext4"
 
 	// Firecracker settings
-	noCpus                 = 2
-	memorySize             = 4096
-	kernelArgs             = "console=ttyS0 reboot=k panic=1 pci=off quiet"
-	firecrackerInitTimeout = 3
+	noCpus     = 2
+	memorySize = 4096
+	kernelArgs = "console=ttyS0 reboot=k panic=1 pci=off quiet"
+	// Polls of the API socket of a starting VMM, 3s in total
+	socketPollInterval = 10 * time.Millisecond
+	socketPollCount    = 300
+	// ID the SDK gives the root drive
+	rootDriveID = "root_drive"
 )
 
-func launchVM(socketPath string) {
-	// Remove the socket path if it exists
-	if _, err := os.Stat(socketPath); err == nil {
-		os.Remove(socketPath)
+// Exit codes of the launcher
+const (
+	exitOK      = 0
+	exitFailure = 1
+	// What a Go panic exits with
+	exitPanic      = 2
+	exitGuestPanic = 3
+	// The restore worked but took longer than -max-restore-latency
+	exitRestoreTooSlow = 4
+)
+
+// Settings for launching and restoring a microVM
+type vmOptions struct {
+	// Absolute paths of the Firecracker binary, guest kernel and root drive
+	firecracker string
+	kernel      string
+	rootfs      string
+	// Read-only config drive with -init-data, empty for none
+	initDrive string
+	// Socket of a vhost-user block backend to attach, empty for none
+	vhostDrive string
+	// Network namespace to run the VMM in, empty for the host namespace
+	netNS string
+	// TAP device set up inside netNS for the guest
+	tapName string
+	// MAC address of the guest NIC, empty to let Firecracker pick one
+	mac string
+	// Attach the guest console to a new pseudo-terminal
+	pty bool
+	// Where the guest serial console goes instead of stdout, see
+	// openSerialOutput
+	serialOut string
+	// Restore even if the host lacks the memory the snapshot needs
+	allowOvercommit bool
+	// What to do when the guest kernel panics, see panicActions
+	onPanic string
+	// Snapshot used by the restore-snapshot and capture-snapshot panic actions
+	panicSnapshot string
+	// Console output that tells the guest is ready, empty to not wait for it
+	readyPattern string
+	// How long to wait for readyPattern
+	readyTimeout time.Duration
+	// Fail restores slower than this, zero for no limit
+	maxRestoreLatency time.Duration
+	// Track dirty pages of a restored VM so it can take diff snapshots
+	diffSnapshots bool
+	// Limits of the cgroup the VMM runs in, none if empty
+	cgroup cgroupLimits
+	// Seconds between balloon statistics updates, zero for no balloon device
+	balloonStatsInterval int64
+	// Don't hand the launcher's stdin to the VMM
+	detached bool
+	// Snapshot a booted VM to this path once readyPattern shows up, then stop it
+	snapshotOnReady string
+	// Backing file swapped in for the root drive of a restored VM, empty to
+	// keep the one the snapshot was taken with
+	rootfsOverride string
+	// Run Firecracker without seccomp and with trace logging
+	debugVMM bool
+	// Take over the stale lock of the socket, set by -force
+	force bool
+	// What to do when resuming a restored VM fails, see resumeFailPolicies
+	onResumeFail string
+	// Guest paths the agent reads after a restore, to prime the caches
+	warmupIO []string
+	// tmpfs directory the memory file is copied to before a restore, empty
+	// to restore from the snapshot's own file
+	memRamdisk string
+	// How often and how many times to check whether the API socket is up
+	socketPollInterval time.Duration
+	socketPollCount    int
+	// Permissions the API socket gets once it's up, zero to keep them
+	socketMode os.FileMode
+	// Host UDS of the guest vsock device, empty for none. A relative path
+	// is relative to the VMM's working directory.
+	vsock string
+	// Working directory of a restored VMM, empty for the launcher's
+	workDir string
+	// Throttling of the drives of a launched VM, nil for none
+	rateLimiter *models.RateLimiter
+	// Snapshot a booted VM to memSnapshot once the guest uses more than
+	// snapshotAtMem bytes, then stop it unless memSnapshotContinue
+	snapshotAtMem       int64
+	memSnapshot         string
+	memSnapshotContinue bool
+	// MMDS data store replacing the one of a restored VM, nil to keep it
+	metadata map[string]interface{}
+	// Run a restored VMM under the jailer, nil to run it directly
+	jail *jailConfig
+}
+
+// Extra Firecracker arguments for the options
+func vmmArgs(opts vmOptions) []string {
+	if !opts.debugVMM {
+		return nil
+	}
+	return []string{"--no-seccomp", "--level", "Trace", "--show-level", "--show-log-origin"}
+}
+
+func buildDrives(opts vmOptions) []models.Drive {
+	var driveOpts []firecracker.DriveOpt
+	if opts.rateLimiter != nil {
+		driveOpts = append(driveOpts, firecracker.WithRateLimiter(*opts.rateLimiter))
+	}
+	drives := firecracker.NewDrivesBuilder(opts.rootfs).WithRootDrive(opts.rootfs, driveOpts...)
+	if opts.initDrive != "" {
+		drives = drives.AddDrive(opts.initDrive, true, driveOpts...)
+	}
+	return drives.Build()
+}
+
+// Prepare the host side of the microVM and adjust the VMM command.
+// Returns the guest console watcher, if one is needed, and a function that
+// undoes the setup.
+func setupHost(cmd *exec.Cmd, opts vmOptions) (*consoleWatcher, func()) {
+	// Firecracker can leave an inherited terminal in raw mode
+	cleanups := []func(){saveTerminal()}
+	cleanup := func() {
+		for i := len(cleanups) - 1; i >= 0; i-- {
+			cleanups[i]()
+		}
+	}
+
+	if opts.detached {
+		cmd.Stdin = nil
+	}
+
+	if opts.pty {
+		p, err := openPTY()
+		if err != nil {
+			cleanup()
+			panic(fmt.Errorf("failed to allocate pty: %v", err))
+		}
+		cleanups = append(cleanups, p.Close)
+		cmd.Stdin = p.master
+		cmd.Stdout = p.master
+		fmt.Println("Guest console available on", p.path)
+	}
+
+	if out, err := openSerialOutput(opts.serialOut); err != nil {
+		cleanup()
+		panic(err)
+	} else if out != nil {
+		cleanups = append(cleanups, func() { out.Close() })
+		cmd.Stdout = out
+	}
+
+	if opts.netNS != "" {
+		netnsCleanup, err := setupNetNS(opts.netNS, opts.tapName)
+		if err != nil {
+			cleanup()
+			panic(fmt.Errorf("failed to set up network namespace: %v", err))
+		}
+		cleanups = append(cleanups, netnsCleanup)
+		if err := inNetNS(cmd, opts.netNS); err != nil {
+			cleanup()
+			panic(fmt.Errorf("failed to run in network namespace: %v", err))
+		}
 	}
 
-	// Create a config structure that specifies how we launch
-	// the microVM.
+	var console *consoleWatcher
+	if opts.onPanic != "" || opts.readyPattern != "" || len(opts.warmupIO) != 0 || captureDmesg {
+		console = newConsoleWatcher(cmd.Stdout)
+		cmd.Stdout = console
+	}
+
+	return console, cleanup
+}
+
+// The configuration the launcher boots a microVM with.
+func vmConfig(socketPath string, args string, opts vmOptions) firecracker.Config {
 	cfg := firecracker.Config{
 		SocketPath:      socketPath,
-		KernelImagePath: kernelPath,
-		KernelArgs:      kernelArgs,
-		Drives:          firecracker.NewDrivesBuilder(rootfsPath).Build(),
+		KernelImagePath: opts.kernel,
+		KernelArgs:      args,
+		Drives:          buildDrives(opts),
 		MachineCfg: models.MachineConfiguration{
 			VcpuCount:       firecracker.Int64(noCpus),
 			MemSizeMib:      firecracker.Int64(memorySize),
@@ -49,18 +220,70 @@ func launchVM(socketPath string) {
 		},
 	}
 
-	// Create a context
-	ctx, cancel := context.WithCancel(context.Background())
+	if opts.vsock != "" {
+		cfg.VsockDevices = []firecracker.VsockDevice{{ID: "vsock0", Path: opts.vsock, CID: guestCID}}
+	}
+
+	// The only way the guest agent reaches MMDS
+	if opts.netNS != "" {
+		cfg.NetworkInterfaces = firecracker.NetworkInterfaces{{
+			StaticConfiguration: &firecracker.StaticNetworkConfiguration{
+				HostDevName: opts.tapName,
+				MacAddress:  opts.mac,
+			},
+			AllowMMDS: true,
+		}}
+	}
+	return cfg
+}
+
+// Boot a microVM and wait for it to exit, or stop it after the
+// -snapshot-on-ready snapshot. Returns true if the guest kernel panicked.
+func launchVM(socketPath string, args string, opts vmOptions) bool {
+	if err := requireFiles(opts.firecracker, opts.kernel, opts.rootfs); err != nil {
+		panic(err)
+	}
+	if err := checkMMDS(opts); err != nil {
+		panic(err)
+	}
+	if opts.vhostDrive != "" {
+		if err := checkVhostBackend(opts.vhostDrive); err != nil {
+			panic(err)
+		}
+	}
+
+	// Remove the socket path if it exists, unless another launcher uses it
+	defer manageVM(socketPath, opts.force)()
+	if _, err := os.Stat(socketPath); err == nil {
+		os.Remove(socketPath)
+	}
+	registerPath("socket", socketPath)
+
+	cfg := vmConfig(socketPath, args, opts)
+
+	// Create a context, cancelled on signals too
+	ctx, cancel := context.WithCancel(vmmContext)
 	defer cancel()
 
 	// Build the command
 	cmd := firecracker.VMCommandBuilder{}.
 		WithSocketPath(socketPath).
-		WithBin(firecrackerPath).
+		WithBin(opts.firecracker).
+		WithArgs(vmmArgs(opts)).
 		WithStdin(os.Stdin).
 		WithStdout(os.Stdout).
 		WithStderr(os.Stderr).
 		Build(ctx)
+	console, hostCleanup := setupHost(cmd, opts)
+	defer hostCleanup()
+
+	var panicked, ready <-chan struct{}
+	if opts.onPanic != "" {
+		panicked = console.watch(guestPanicPattern)
+	}
+	if opts.snapshotOnReady != "" {
+		ready = console.watch(opts.readyPattern)
+	}
 
 	// Create a logger to have a nice output
 	logger := log.New()
@@ -70,23 +293,150 @@ func launchVM(socketPath string) {
 		ctx,
 		cfg,
 		firecracker.WithProcessRunner(cmd),
+		firecracker.WithClient(newAPIClient(cfg.SocketPath)),
 		firecracker.WithLogger(log.NewEntry(logger)))
 
 	if err != nil {
 		panic(fmt.Errorf("failed to create new machine: %v", err))
 	}
 
+	cgroupCleanup := func() {}
+	defer func() { cgroupCleanup() }()
+	if !opts.cgroup.empty() {
+		machine.Handlers.FcInit = machine.Handlers.FcInit.AppendAfter(
+			firecracker.StartVMMHandlerName,
+			firecracker.Handler{
+				Name: "fcinit.JoinCgroup",
+				Fn: func(ctx context.Context, m *firecracker.Machine) error {
+					pid, err := m.PID()
+					if err == nil {
+						cgroupCleanup, err = joinCgroup(cgroupName(socketPath), pid, opts.cgroup)
+					}
+					return err
+				},
+			})
+	}
+
+	if opts.socketMode != 0 {
+		machine.Handlers.FcInit = machine.Handlers.FcInit.AppendAfter(
+			firecracker.StartVMMHandlerName, newSocketModeHandler(opts.socketMode))
+	}
+
+	if opts.vhostDrive != "" {
+		machine.Handlers.FcInit = machine.Handlers.FcInit.AppendAfter(
+			firecracker.AttachDrivesHandlerName, newVhostDriveHandler(opts.vhostDrive))
+	}
+
+	if opts.balloonStatsInterval > 0 {
+		// An empty balloon, only there to report guest memory statistics
+		machine.Handlers.FcInit = machine.Handlers.FcInit.AppendAfter(
+			firecracker.CreateMachineHandlerName,
+			firecracker.NewCreateBalloonHandler(0, true, opts.balloonStatsInterval))
+	}
+
 	// Start the microVM
+	start := time.Now()
 	if err := machine.Start(ctx); err != nil {
 		panic(fmt.Errorf("Failed to start machine: %v", err))
 	}
+	summary.timing("vmm_start", time.Since(start))
 	defer machine.StopVMM()
+	unregister := func() {}
+	pid, err := machine.PID()
+	if err == nil {
+		unregister = registerProcess(pid)
+	}
+	recordEvent("start", socketPath, "")
+
+	exited := make(chan error, 1)
+	go func() {
+		// The SDK reaped the VMM by then. Not ctx, which is cancelled
+		// before the VMM is.
+		err := machine.Wait(context.Background())
+		unregister()
+		exited <- err
+	}()
+
+	var memReached <-chan struct{}
+	if opts.snapshotAtMem != 0 {
+		interval := time.Duration(opts.balloonStatsInterval) * time.Second
+		memReached = watchGuestMem(ctx, machine, opts.snapshotAtMem, interval)
+	}
 
 	// wait for the VMM to exit
-	if err := machine.Wait(ctx); err != nil {
+	guestPanic, stopped := false, false
+	for waiting := true; waiting; {
+		waiting = false
+		select {
+		case err = <-exited:
+		case <-ready:
+			fmt.Println("Guest ready after:", time.Since(start))
+			summary.timing("guest_ready", time.Since(start))
+			quiesceAndSnapshot(socketPath, opts.snapshotOnReady, console)
+			fmt.Println("Snapshot on ready:", opts.snapshotOnReady)
+			stopped = true
+			machine.StopVMM()
+			err = <-exited
+		case <-memReached:
+			fmt.Println("Guest memory threshold reached after:", time.Since(start))
+			quiesceAndSnapshot(socketPath, opts.memSnapshot, console)
+			fmt.Println("Snapshot at memory threshold:", opts.memSnapshot)
+			if opts.memSnapshotContinue {
+				memReached = nil
+				waiting = true
+				continue
+			}
+			stopped = true
+			machine.StopVMM()
+			err = <-exited
+		case <-panicked:
+			guestPanic = true
+			log.Error("Guest kernel panic detected")
+			recordEvent("crash", socketPath, "")
+			if opts.onPanic == "capture-snapshot" {
+				// The guest is gone, no point in asking it to quiesce
+				createSnapshot(socketPath, opts.panicSnapshot)
+			}
+			// panic=1 makes the guest reboot, which stops Firecracker
+			err = <-exited
+		}
+	}
+	recordEvent("stop", socketPath, "")
+
+	if guestPanic {
+		log.Errorf("Guest console before exit:\n%s", strings.Join(console.context(), "\n"))
+	}
+	// A hot upgrade stops the VMM on purpose
+	handed := handedOver(socketPath, pid)
+	if err != nil && !guestPanic && !stopped && !stopping() && !handed {
 		panic(fmt.Errorf("Wait returned an error %s", err))
 	}
 	os.Remove(socketPath)
+	return guestPanic
+}
+
+// How many times createSnapshot retries a failed pause, set by -pause-retries
+var pauseRetries = 3
+
+// Pause the VM, retrying with a doubling backoff on a busy guest.
+// If every attempt fails the VM is resumed, in case a timed out request
+// paused it after all.
+func pauseWithRetry(ctx context.Context, machine *firecracker.Machine) error {
+	backoff := 100 * time.Millisecond
+	for attempt := 0; ; attempt++ {
+		err := machine.PauseVM(ctx)
+		if err == nil {
+			recordEvent("pause", machine.Cfg.SocketPath, "")
+			return nil
+		}
+		if attempt == pauseRetries {
+			machine.ResumeVM(ctx)
+			return fmt.Errorf("failed to pause VM after %d attempts: %v", attempt+1, err)
+		}
+		log.Warnf("Pause attempt %d failed, retrying in %v: %v", attempt+1, backoff, err)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
 }
 
 // Create a snapshot to a given path.
@@ -98,97 +448,650 @@ func createSnapshot(socketPath string, snapshotPath string) {
 	// Create a logger to have a nice output
 	logger := log.New()
 
-	machine, err := firecracker.NewMachine(ctx, cfg, firecracker.WithLogger(log.NewEntry(logger)))
+	machine, err := firecracker.NewMachine(ctx, cfg, firecracker.WithClient(newAPIClient(cfg.SocketPath)),
+		firecracker.WithLogger(log.NewEntry(logger)))
 	if err != nil {
 		panic(fmt.Errorf("failed to create new machine: %v", err))
 	}
 
-	machine.PauseVM(ctx)
+	if scrubMemWait > 0 {
+		if err := scrubGuestMemory(ctx, machine); err != nil {
+			panic(err)
+		}
+	}
+
+	if err := pauseWithRetry(ctx, machine); err != nil {
+		panic(err)
+	}
 
 	start := time.Now()
-	machine.CreateSnapshot(ctx, snapshotPath+".mem", snapshotPath+".file",
+	err = machine.CreateSnapshot(ctx, snapshotPath+".mem", snapshotPath+".file",
 		func(data *ops.CreateSnapshotParams) {
 			data.Body.SnapshotType = "Diff"
 		})
 	fmt.Println("Created snapshot duration:", time.Since(start))
+	if err == nil {
+		recordEvent("snapshot", socketPath, snapshotPath)
+		summary.timing("create_snapshot", time.Since(start))
+		if info, err := os.Stat(snapshotPath + ".mem"); err == nil {
+			summary.size("mem_file", info.Size())
+		}
+	}
 
 	machine.ResumeVM(ctx)
-}
+	recordEvent("resume", socketPath, "")
 
-// Load a snapshot from a given path.
-// Handles VM socket path and a snapshot path.
-func loadSnapshot(socketPath string, snapshotPath string) {
-	// Remove the socket path if it exists
-	if _, err := os.Stat(socketPath); err == nil {
-		os.Remove(socketPath)
+	// Checksumming the memory file takes a while, do it with the VM running
+	if err == nil {
+		var manifest *snapshotManifest
+		manifest, err = newManifest(socketPath, snapshotPath, "Diff")
+		if err == nil {
+			err = writeManifest(snapshotPath, manifest)
+		}
 	}
 
-	cfg := firecracker.Config{
-		SocketPath:        socketPath,
-		DisableValidation: true,
+	if err != nil {
+		panic(fmt.Errorf("failed to create snapshot: %v", err))
 	}
+}
 
-	// Create a context
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
+func main() {
+	os.Exit(run())
+}
 
-	// Build the command
-	cmd := firecracker.VMCommandBuilder{}.
-		WithSocketPath(socketPath).
-		WithBin(firecrackerPath).
-		WithStdin(os.Stdin).
-		WithStdout(os.Stdout).
-		WithStderr(os.Stderr).
-		Build(ctx)
+// Run the requested operation, returning the process exit code.
+// Deferred cleanups run before the launcher exits.
+func run() (code int) {
+	socketPath := flag.String("socket", "", "UDS socket path for Firecracker to use.")
+	toSnapshot := flag.String("toSnapshot", "", "Save snapshot to file.")
+	fromSnapshot := flag.String("fromSnapshot", "", "Load snapshot from a file.")
+	moduleBlocklist := flag.String("module-blocklist", "", "Comma separated list of guest kernel modules to block from loading.")
+	clocksource := flag.String("clocksource", "", "Guest clocksource: "+strings.Join(clocksources, ", ")+".")
+	initPath := flag.String("init", "", "Guest binary to run as PID 1.")
+	pprofAddr := flag.String("pprof-addr", "", "Serve net/http/pprof for the launcher on this address.")
+	cpuProfile := flag.String("cpuprofile", "", "Write a CPU profile of the launcher to file.")
+	memProfile := flag.String("memprofile", "", "Write a memory profile of the launcher to file.")
+	netNS := flag.String("netns", "", "Run Firecracker inside this network namespace, created if missing.")
+	tapName := flag.String("tap", "tap0", "TAP device to set up for the guest inside the network namespace.")
+	usePTY := flag.Bool("pty", false, "Attach the guest console to a new pseudo-terminal instead of stdio.")
+	allowOvercommit := flag.Bool("allow-overcommit", false, "Restore a snapshot even if the host lacks the memory it needs.")
+	snapshotBuf := flag.String("snapshot-buf-size", "1M", "Buffer size for the launcher's own snapshot file I/O.")
+	validateMemory := flag.String("validate-mem", "", "Check a snapshot's memory file against its manifest and exit.")
+	sandboxSnapshot := flag.String("sandbox-validate", "", "Check that a snapshot restores and resumes, under the jailer in a throwaway chroot, and exit.")
+	jailerPath := flag.String("jailer", "jailer", "Jailer binary used by -sandbox-validate.")
+	jailerUID := flag.Int("jailer-uid", 65534, "User the jailer runs the VMM as.")
+	jailerGID := flag.Int("jailer-gid", 65534, "Group the jailer runs the VMM as.")
+	onPanic := flag.String("on-panic", "", "Action on guest kernel panic: "+strings.Join(panicActions, ", ")+".")
+	panicSnapshot := flag.String("panic-snapshot", "", "Snapshot to restore from or capture to on guest panic.")
+	panicExitCode := flag.Int("panic-exit-code", exitGuestPanic, "Exit code for -on-panic exit-with-code and capture-snapshot.")
+	readyPattern := flag.String("ready-pattern", "", "Console output telling the guest is ready, waited for after a restore.")
+	readyTimeout := flag.Duration("ready-timeout", 30*time.Second, "How long to wait for -ready-pattern.")
+	maxRestoreLatency := flag.Duration("max-restore-latency", 0, "Fail a restore whose load plus guest ready time exceeds this.")
+	settle := flag.Duration("settle-duration", 0, "How long restored guests run before the new snapshot with both -fromSnapshot and -toSnapshot, or before -density-test measures them.")
+	balloonStats := flag.Int64("balloon-stats", 0, "Add a balloon device reporting guest memory statistics every N seconds.")
+	monitorInterval := flag.Duration("monitor", 0, "Print host, balloon and MMDS metrics of a running VM as JSON lines at this interval.")
+	ociImage := flag.String("oci", "", "Build the rootfs from this OCI image reference and boot from it.")
+	initData := flag.String("init-data", "", "Directory whose files are handed to the guest on a read-only config drive.")
+	roundtripPrefix := flag.String("roundtrip", "", "Snapshot, restore and re-snapshot the VM under this path prefix and compare the memory.")
+	roundtripTolerance := flag.String("roundtrip-tolerance", "", "Comma separated start-end memory file ranges allowed to differ in -roundtrip.")
+	scriptPath := flag.String("script", "", "Run the operations listed in this file against named VMs.")
+	pauseRetryCount := flag.Int("pause-retries", pauseRetries, "How many times to retry pausing the VM before a snapshot.")
+	noHostInfo := flag.Bool("no-host-info", false, "Don't record the host CPU, kernel and Firecracker versions in snapshot manifests.")
+	hotUpgradePath := flag.String("hot-upgrade", "", "Move the running VM to -new-firecracker through a full snapshot at this path.")
+	newFirecracker := flag.String("new-firecracker", "", "Firecracker binary to move the VM to with -hot-upgrade.")
+	pollInterval := flag.Duration("socket-poll-interval", socketPollInterval, "How often to check whether a starting Firecracker's API socket is up.")
+	pollCount := flag.Int("socket-poll-count", socketPollCount, "How many times to check for the API socket before giving up.")
+	socketMode := flag.String("socket-mode", "", "Octal permissions the API socket gets as soon as it's up, e.g. 0660.")
+	debugVMM := flag.Bool("debug-vmm", false, "Insecure: run Firecracker without seccomp and with trace logging.")
+	warmupIO := flag.String("warmup-io", "", "Comma separated guest paths the guest agent reads after a restore to warm up caches.")
+	serialPorts := flag.Int("serial-ports", 1, "Number of guest serial ports, Firecracker has one (ttyS0), 0 for none.")
+	serialOut := flag.String("serial-out", "stdout", "Where the guest serial console goes: stdout, file:<path> or fifo:<path>.")
+	quiesce := flag.String("quiesce-cmd", "", "Guest command the guest agent runs before a snapshot, for application-consistent snapshots.")
+	quiesceWait := flag.Duration("quiesce-timeout", quiesceTimeout, "How long the guest gets to run -quiesce-cmd.")
+	benchPrefix := flag.String("bench-snapshot", "", "Measure full snapshot write throughput of the VM with snapshots under this path prefix.")
+	benchRuns := flag.Int("bench-runs", 3, "How many snapshots -bench-snapshot takes.")
+	onResumeFail := flag.String("on-resume-fail", "fail", "When resuming a restored VM fails: "+strings.Join(resumeFailPolicies, ", ")+".")
+	pinMem := flag.Bool("pin-mem", false, "Lock the -fromSnapshot memory file in the page cache while the launcher runs.")
+	mac := flag.String("mac", "", "MAC address of the guest NIC.")
+	vmName := flag.String("name", "", "Name of the VM, the guest MAC is derived from it if -mac isn't given.")
+	showInvocation := flag.Bool("print-invocation", false, "Print the resolved flags as a command line and as JSON before running.")
+	vhostDrive := flag.String("vhost-drive", "", "Attach a vhost-user block device served by the backend on this socket.")
+	churnInterval := flag.Duration("track-churn", 0, "Take a diff snapshot of the running VM at this interval and print the dirtied pages as CSV.")
+	churnDuration := flag.Duration("duration", time.Minute, "How long -track-churn runs.")
+	trim := flag.Bool("trim-before-snapshot", false, "Ask the guest agent to run fstrim before a snapshot.")
+	dmesg := flag.Bool("capture-dmesg", false, "Save the guest dmesg before a snapshot and after a restore, and print what the restore added.")
+	cgroupMem := flag.String("cgroup-mem", "", "Memory limit of the cgroup the VMM runs in, e.g. 4G.")
+	cgroupCPU := flag.Float64("cgroup-cpu", 0, "CPU limit of the cgroup the VMM runs in, in CPUs, e.g. 1.5.")
+	trace := flag.Bool("trace-api", false, "Log every request sent to the Firecracker API with its body.")
+	vsock := flag.String("vsock", "", "Add a vsock device with this host UDS to launched VMs, relative to the VMM's working directory.")
+	vsockPort := flag.Uint("vsock-serve", 0, "Serve requests from stdin with VMs restored from -fromSnapshot, whose guest agent connects to this vsock port.")
+	densityClones := flag.Int("density-test", 0, "Restore this many clones of -fromSnapshot and report how many VMs fit in a GiB of host memory.")
+	rootflags := flag.String("rootflags", "", "Comma separated root filesystem mount options, e.g. data=writeback,commit=60.")
+	metadataPath := flag.String("metadata", "", "JSON file replacing the MMDS data of a restored VM.")
+	checkSupport := flag.Bool("check-snapshot-support", false, "Check that the host KVM has the capabilities snapshot/restore needs and exit.")
+	dirtyRatio := flag.Float64("dirty-ratio", 0, "Have the guest agent dirty this fraction of guest memory, then take a diff snapshot and compare its size.")
+	dirtyWait := flag.Duration("dirty-wait", 10*time.Second, "How long the guest agent gets to dirty memory for -dirty-ratio.")
+	profileHostRun := flag.Bool("profile-host", false, "Benchmark restoring -fromSnapshot and print a JSON report to compare with other hosts.")
+	controlAddr := flag.String("control-addr", "", "Serve the state of the -vsock-serve VMs over HTTP on this address.")
+	poolSize := flag.Int("pool-size", 2, "How many VMs -vsock-serve keeps restored ahead of requests.")
+	snapshotAtMem := flag.String("snapshot-at-mem", "", "Snapshot a launched VM once the guest uses more than this much memory, e.g. 512M. Needs -balloon-stats.")
+	memSnapshot := flag.String("snapshot-at-mem-path", "", "Where -snapshot-at-mem saves the snapshot.")
+	memSnapshotThen := flag.String("snapshot-at-mem-then", "exit", "After the -snapshot-at-mem snapshot: "+strings.Join(memSnapshotActions, ", ")+".")
+	ioProfileName := flag.String("io-profile", "", "Throttle the drives of launched VMs with this named I/O profile.")
+	once := flag.Bool("once", false, "Remove everything the launcher created when it exits, however it exits.")
+	skipArchCheck := flag.Bool("skip-arch-check", false, "Don't check that the kernel or snapshot matches the host architecture.")
+	eventLogPath := flag.String("event-log", "", "Append VM lifecycle events to this file as JSON lines.")
+	force := flag.Bool("force", false, "Take over the lock of a VM whose launcher is gone.")
+	memRamdisk := flag.String("mem-ramdisk", "", "Copy the snapshot memory file to this tmpfs directory before restoring it.")
+	inspectPath := flag.String("inspect", "", "Print a summary of a snapshot without restoring it and exit.")
+	reportPath := flag.String("report-file", "", "Write a versioned JSON summary of the run's measurements to this file, failed runs included.")
+	compactPath := flag.String("compact", "", "Replace the diff snapshot chain in this JSON file with one full snapshot.")
+	showFDs := flag.Bool("fds", false, "Print the files held open by the VMM of -socket or -pid and exit.")
+	vmmPid := flag.Int("pid", 0, "Process ID of the VMM, instead of looking it up from -socket.")
+	asJSON := flag.Bool("json", false, "Print -fds as JSON.")
+	scrubMem := flag.Duration("scrub-mem", 0, "Ask the guest agent to zero free memory and wait this long before a snapshot.")
+	rootfsOverride := flag.String("rootfs", "", "Unsupported: back the root drive of a restored VM with this file instead.")
+	snapshotOnReady := flag.String("snapshot-on-ready", "", "Boot a VM, snapshot it to this path once -ready-pattern shows up and stop it.")
+	continueOnError := flag.Bool("continue-on-error", false, "Keep running a -script after a step fails.")
+	var kernelArgOverrides stringList
+	flag.Var(&kernelArgOverrides, "kernel-arg", "Guest kernel argument key[=value] merged into the defaults, can be repeated.")
+	flag.Parse()
 
-	logger := log.New()
+	// Deferred first so that it runs last, after the cleanups of the code
+	// that created the resources, on panics too
+	onceMode = *once
+	if onceMode {
+		defer cleanupResources()
+	}
+	// Whether something has to run on exit that a signal would skip
+	interruptible := onceMode || *reportPath != "" || *cpuProfile != "" || *memProfile != ""
 
-	// Start Firecracker
-	err := cmd.Start()
-	if err != nil {
-		logger.Error("Failed to start Firecracker")
+	if *reportPath != "" {
+		// The operation is recorded by the branch run() dispatches to
+		summary = newRunReport(firecrackerPath)
+		// Written on panics too, marked failed
+		defer func() {
+			failure := recover()
+			exitCode := code
+			if failure != nil {
+				exitCode = exitPanic
+			}
+			if err := summary.write(*reportPath, exitCode, failure); err != nil {
+				log.Errorf("Failed to write the report: %v", err)
+			}
+			if failure != nil {
+				panic(failure)
+			}
+		}()
 	}
 
-	machine, err := firecracker.NewMachine(ctx, cfg, firecracker.WithLogger(log.NewEntry(logger)))
+	// Deferred so that profiles are flushed on panics too
+	stopProfiling, err := startProfiling(*pprofAddr, *cpuProfile, *memProfile)
 	if err != nil {
-		panic(fmt.Errorf("failed to create new machine: %v", err))
+		panic(err)
 	}
+	defer stopProfiling()
+	// A signal returns from here instead of killing the launcher, so that
+	// the deferred functions above run
+	return untilSignal(interruptible, func() int {
 
-	// TODO: WaitForSocket interface could look better
-	errCh := make(chan error)
-	machine.WaitForSocket(time.Duration(firecrackerInitTimeout)*time.Second, errCh)
+		bufSize, err := parseSize(*snapshotBuf)
+		if err != nil || bufSize == 0 {
+			panic(fmt.Errorf("invalid snapshot buffer size %q", *snapshotBuf))
+		}
+		snapshotBufSize = int(bufSize)
 
-	start := time.Now()
-	machine.LoadSnapshot(ctx, snapshotPath+".mem", snapshotPath+".file")
-	fmt.Println("Load snapshot duration:", time.Since(start))
+		if *pauseRetryCount < 0 {
+			panic(fmt.Errorf("-pause-retries must not be negative, got %d", *pauseRetryCount))
+		}
+		pauseRetries = *pauseRetryCount
+		recordHostInfo = !*noHostInfo
+		scrubMemWait = *scrubMem
+		quiesceCmd = *quiesce
+		quiesceTimeout = *quiesceWait
+		trimBeforeSnapshot = *trim
+		captureDmesg = *dmesg
+		traceAPI = *trace
 
-	machine.ResumeVM(ctx)
+		err = makeAbsolute(socketPath, toSnapshot, fromSnapshot, validateMemory,
+			panicSnapshot, initData, roundtripPrefix, scriptPath, snapshotOnReady, rootfsOverride,
+			hotUpgradePath, newFirecracker, compactPath, inspectPath,
+			memRamdisk, eventLogPath, benchPrefix, vhostDrive, memSnapshot, sandboxSnapshot)
+		if err != nil {
+			panic(err)
+		}
 
-	// wait for the VMM to exit
-	if err := machine.Wait(ctx); err != nil {
-		panic(fmt.Errorf("Wait returned an error %s", err))
-	}
-}
+		if *showInvocation {
+			printInvocation()
+		}
 
-func main() {
-	socketPath := flag.String("socket", "", "UDS socket path for Firecracker to use.")
-	toSnapshot := flag.String("toSnapshot", "", "Save snapshot to file.")
-	fromSnapshot := flag.String("fromSnapshot", "", "Load snapshot from a file.")
-	flag.Parse()
+		if *eventLogPath != "" {
+			if err := openEventLog(*eventLogPath); err != nil {
+				panic(fmt.Errorf("failed to open event log: %v", err))
+			}
+		}
 
-	if *socketPath == "" {
-		panic(fmt.Errorf("UDS socket path needed."))
-	}
+		if *validateMemory != "" {
+			summary.operation("validate-mem")
+			if err := validateMem(*validateMemory); err != nil {
+				fmt.Printf("%s.mem: corrupt: %v\n", *validateMemory, err)
+				return exitFailure
+			}
+			fmt.Printf("%s.mem: OK\n", *validateMemory)
+			return exitOK
+		}
 
-	if *toSnapshot != "" {
-		createSnapshot(*socketPath, *toSnapshot)
-		os.Exit(0)
-	}
+		if *checkSupport {
+			summary.operation("check-snapshot-support")
+			missing, err := checkSnapshotSupport()
+			if err != nil {
+				fmt.Println(err)
+				return exitFailure
+			}
+			if len(missing) != 0 {
+				fmt.Println("Snapshot/restore won't work, missing:", strings.Join(missing, ", "))
+				return exitFailure
+			}
+			return exitOK
+		}
 
-	if *fromSnapshot != "" {
-		loadSnapshot(*socketPath, *fromSnapshot)
-		os.Exit(0)
-	}
+		if *inspectPath != "" {
+			summary.operation("inspect")
+			if err := inspectSnapshot(*inspectPath); err != nil {
+				fmt.Println(err)
+				return exitFailure
+			}
+			return exitOK
+		}
+
+		if *showFDs {
+			summary.operation("show-fds")
+			pid := *vmmPid
+			if pid == 0 {
+				if pid, err = findVMMPid(*socketPath); err != nil {
+					panic(err)
+				}
+			}
+			if err := printFDs(pid, *asJSON); err != nil {
+				panic(err)
+			}
+			return exitOK
+		}
+
+		// Scripts name their VMs themselves, the sandbox has its socket in the
+		// chroot
+		if *socketPath == "" && *scriptPath == "" && *sandboxSnapshot == "" {
+			panic(fmt.Errorf("UDS socket path needed."))
+		}
+
+		if err := validatePanicAction(*onPanic, *panicSnapshot); err != nil {
+			panic(err)
+		}
+		if *debugVMM {
+			if *hotUpgradePath != "" {
+				panic(fmt.Errorf("-debug-vmm is for debugging, not for -hot-upgrade"))
+			}
+			if *sandboxSnapshot != "" {
+				panic(fmt.Errorf("-debug-vmm turns off the seccomp filters -sandbox-validate relies on"))
+			}
+			log.Warn("INSECURE: -debug-vmm runs Firecracker without seccomp filters, don't use it with untrusted guests")
+		}
+		if err := validateResumeFailPolicy(*onResumeFail); err != nil {
+			panic(err)
+		}
+		if err := validateSerialPorts(*serialPorts); err != nil {
+			panic(err)
+		}
+		if *usePTY && *serialOut != "stdout" {
+			panic(fmt.Errorf("-pty and -serial-out both pick where the console goes"))
+		}
+		if *pollInterval <= 0 || *pollCount <= 0 {
+			panic(fmt.Errorf("-socket-poll-interval and -socket-poll-count must be positive"))
+		}
+		if *snapshotOnReady != "" && *readyPattern == "" {
+			panic(fmt.Errorf("-snapshot-on-ready needs -ready-pattern"))
+		}
+
+		opts := vmOptions{
+			firecracker:          firecrackerPath,
+			kernel:               kernelPath,
+			rootfs:               rootfsPath,
+			netNS:                *netNS,
+			tapName:              *tapName,
+			pty:                  *usePTY,
+			vhostDrive:           *vhostDrive,
+			serialOut:            *serialOut,
+			allowOvercommit:      *allowOvercommit,
+			onPanic:              *onPanic,
+			panicSnapshot:        *panicSnapshot,
+			readyPattern:         *readyPattern,
+			readyTimeout:         *readyTimeout,
+			maxRestoreLatency:    *maxRestoreLatency,
+			balloonStatsInterval: *balloonStats,
+			snapshotOnReady:      *snapshotOnReady,
+			rootfsOverride:       *rootfsOverride,
+			debugVMM:             *debugVMM,
+			force:                *force,
+			memRamdisk:           *memRamdisk,
+			onResumeFail:         *onResumeFail,
+			socketPollInterval:   *pollInterval,
+			socketPollCount:      *pollCount,
+			vsock:                *vsock,
+		}
+		if err := makeAbsolute(&opts.firecracker, &opts.kernel, &opts.rootfs); err != nil {
+			panic(err)
+		}
+		if opts.warmupIO, err = parseGuestPaths(*warmupIO); err != nil {
+			panic(err)
+		}
+		if *snapshotAtMem != "" {
+			opts.snapshotAtMem, err = parseSize(*snapshotAtMem)
+			if err != nil || opts.snapshotAtMem == 0 {
+				panic(fmt.Errorf("invalid memory threshold %q", *snapshotAtMem))
+			}
+			if opts.balloonStatsInterval <= 0 {
+				panic(fmt.Errorf("-snapshot-at-mem reads the guest memory use from balloon statistics, enable them with -balloon-stats"))
+			}
+			if *memSnapshot == "" {
+				panic(fmt.Errorf("-snapshot-at-mem needs -snapshot-at-mem-path"))
+			}
+			if err := validateMemSnapshotAction(*memSnapshotThen); err != nil {
+				panic(err)
+			}
+			opts.memSnapshot = *memSnapshot
+			opts.memSnapshotContinue = *memSnapshotThen == "continue"
+		}
+		if *socketMode != "" {
+			if opts.socketMode, err = parseSocketMode(*socketMode); err != nil {
+				panic(err)
+			}
+		}
+		if *metadataPath != "" {
+			if opts.metadata, err = readMetadata(*metadataPath); err != nil {
+				panic(err)
+			}
+		}
+		if *ioProfileName != "" {
+			if opts.rateLimiter, err = ioRateLimiter(*ioProfileName); err != nil {
+				panic(err)
+			}
+		}
+		if *cgroupMem != "" {
+			opts.cgroup.memBytes, err = parseSize(*cgroupMem)
+			if err != nil || opts.cgroup.memBytes == 0 {
+				panic(fmt.Errorf("invalid cgroup memory limit %q", *cgroupMem))
+			}
+		}
+		if *cgroupCPU < 0 {
+			panic(fmt.Errorf("-cgroup-cpu must not be negative, got %v", *cgroupCPU))
+		}
+		opts.cgroup.cpus = *cgroupCPU
+		switch {
+		case *mac != "":
+			hw, err := net.ParseMAC(*mac)
+			if err != nil || len(hw) != 6 {
+				panic(fmt.Errorf("invalid MAC address %q", *mac))
+			}
+			opts.mac = hw.String()
+		case *vmName != "":
+			opts.mac = macFromName(*vmName)
+			log.Infof("Guest MAC %s derived from name %s", opts.mac, *vmName)
+		}
+
+		if *monitorInterval > 0 {
+			summary.operation("monitor")
+			monitor(*socketPath, *monitorInterval)
+			return exitOK
+		}
+
+		if *sandboxSnapshot != "" {
+			summary.operation("sandbox-validate")
+			jail := &jailConfig{
+				jailer: *jailerPath,
+				id:     fmt.Sprintf("sandbox-validate-%d", os.Getpid()),
+				uid:    *jailerUID,
+				gid:    *jailerGID,
+			}
+			return sandboxValidate(*sandboxSnapshot, jail, opts)
+		}
+
+		// Operations that snapshot or replace a running VM lock it while they
+		// run, one at a time per VM
+		if *churnInterval != 0 {
+			summary.operation("track-churn")
+			defer lockVM(*socketPath, *force)()
+			trackChurn(*socketPath, *churnInterval, *churnDuration)
+			return exitOK
+		}
+
+		if *benchPrefix != "" {
+			summary.operation("bench-snapshot")
+			defer lockVM(*socketPath, *force)()
+			benchSnapshot(*socketPath, *benchPrefix, *benchRuns)
+			return exitOK
+		}
+
+		if *compactPath != "" {
+			summary.operation("compact")
+			defer lockVM(*socketPath, *force)()
+			compactChain(*compactPath, *socketPath, opts)
+			return exitOK
+		}
+
+		if *hotUpgradePath != "" {
+			summary.operation("hot-upgrade")
+			if *newFirecracker == "" {
+				panic(fmt.Errorf("-hot-upgrade needs -new-firecracker"))
+			}
+			return hotUpgrade(*socketPath, *hotUpgradePath, *newFirecracker, *force, opts)
+		}
+
+		if *roundtripPrefix != "" {
+			summary.operation("roundtrip")
+			tolerated, err := parseRegions(*roundtripTolerance)
+			if err != nil {
+				panic(err)
+			}
+			defer lockVM(*socketPath, *force)()
+			diffs, err := roundtrip(*socketPath, *roundtripPrefix, tolerated, opts)
+			if err != nil {
+				panic(err)
+			}
+			for _, r := range diffs {
+				fmt.Println("Memory differs:", r)
+			}
+			if len(diffs) != 0 {
+				return exitFailure
+			}
+			fmt.Println("Snapshots are identical")
+			return exitOK
+		}
+
+		if *pinMem && *fromSnapshot != "" {
+			size, unpin, err := pinFile(*fromSnapshot + ".mem")
+			if err != nil {
+				panic(err)
+			}
+			defer unpin()
+			log.Infof("Pinned %s.mem, %d MiB of host RAM", *fromSnapshot, size>>20)
+		}
+
+		if !*skipArchCheck {
+			if *fromSnapshot != "" {
+				err = checkSnapshotArch(*fromSnapshot)
+			} else if *toSnapshot == "" {
+				err = checkKernelArch(opts.kernel)
+			}
+			if err != nil {
+				panic(err)
+			}
+		}
+
+		if *vsockPort != 0 {
+			summary.operation("vsock-serve")
+			if *fromSnapshot == "" || opts.vsock == "" {
+				panic(fmt.Errorf("-vsock-serve needs -fromSnapshot and the -vsock the snapshot was taken with"))
+			}
+			if *poolSize < 1 {
+				panic(fmt.Errorf("-pool-size must be at least 1, got %d", *poolSize))
+			}
+			// Every VMM of the pool binds the vsock UDS, in its own directory
+			if filepath.IsAbs(opts.vsock) && *poolSize > 1 {
+				panic(fmt.Errorf("-vsock-serve with -pool-size %d needs a snapshot taken with a relative -vsock", *poolSize))
+			}
+			var states *vmStates
+			if *controlAddr != "" {
+				states = newVMStates()
+				if err := serveControl(*controlAddr, states); err != nil {
+					panic(err)
+				}
+			}
+			return vsockServe(*socketPath, *fromSnapshot, uint32(*vsockPort), *poolSize, states, opts)
+		}
+
+		if *densityClones != 0 {
+			summary.operation("density-test")
+			if *fromSnapshot == "" {
+				panic(fmt.Errorf("-density-test needs -fromSnapshot"))
+			}
+			if *densityClones < 0 {
+				panic(fmt.Errorf("-density-test must be positive, got %d", *densityClones))
+			}
+			if *settle < 0 {
+				panic(fmt.Errorf("settle duration must not be negative, got %v", *settle))
+			}
+			return densityTest(*socketPath, *fromSnapshot, *densityClones, *settle, opts)
+		}
+
+		if *profileHostRun {
+			summary.operation("profile-host")
+			if *fromSnapshot == "" {
+				panic(fmt.Errorf("-profile-host needs -fromSnapshot"))
+			}
+			profileHost(*socketPath, *fromSnapshot, opts)
+			return exitOK
+		}
+
+		if *fromSnapshot != "" && *toSnapshot != "" {
+			summary.operation("restore-and-snapshot")
+			restoreAndSnapshot(*socketPath, *fromSnapshot, *toSnapshot, *settle, opts)
+			return exitOK
+		}
+
+		if *dirtyRatio != 0 {
+			summary.operation("dirty-ratio")
+			if *dirtyRatio < 0 || *dirtyRatio > 1 {
+				panic(fmt.Errorf("-dirty-ratio must be between 0 and 1, got %v", *dirtyRatio))
+			}
+			snapshotPath := *toSnapshot
+			if snapshotPath == "" {
+				// Only there to be measured
+				snapshotPath = *socketPath + ".dirty"
+				registerSnapshot(snapshotPath)
+				defer os.Remove(snapshotPath + ".mem")
+				defer os.Remove(snapshotPath + ".file")
+				defer os.Remove(manifestPath(snapshotPath))
+			}
+			defer lockVM(*socketPath, *force)()
+			dirtyAndSnapshot(*socketPath, snapshotPath, *dirtyRatio, *dirtyWait)
+			return exitOK
+		}
+
+		if *toSnapshot != "" {
+			summary.operation("snapshot")
+			defer lockVM(*socketPath, *force)()
+			quiesceAndSnapshot(*socketPath, *toSnapshot, nil)
+			return exitOK
+		}
+
+		if *fromSnapshot != "" {
+			summary.operation("restore")
+			return loadSnapshot(*socketPath, *fromSnapshot, opts)
+		}
+
+		if *ociImage != "" {
+			opts.rootfs, err = ociRootfs(*ociImage)
+			if err == nil {
+				err = makeAbsolute(&opts.rootfs)
+			}
+			if err != nil {
+				panic(fmt.Errorf("failed to build rootfs from OCI image: %v", err))
+			}
+		}
+
+		if *initData != "" {
+			opts.initDrive, err = buildInitDrive(*initData, *socketPath)
+			if err != nil {
+				panic(err)
+			}
+			log.Infof("Init data from %s on drive %s", *initData, opts.initDrive)
+		}
+
+		args := withSerialPorts(kernelArgs, *serialPorts)
+		if *moduleBlocklist != "" {
+			var blocklist []string
+			args, blocklist, err = withModuleBlocklist(args, *moduleBlocklist)
+			if err != nil {
+				panic(fmt.Errorf("invalid module blocklist: %v", err))
+			}
+			log.Infof("Guest module blocklist: %s", strings.Join(blocklist, ","))
+		}
+
+		if *initPath != "" {
+			args, err = withInit(args, *initPath)
+			if err != nil {
+				panic(err)
+			}
+		}
+
+		if *rootflags != "" {
+			var flags string
+			args, flags, err = withRootflags(args, *rootflags)
+			if err != nil {
+				panic(err)
+			}
+			log.Infof("Guest root filesystem options: rootflags=%s", flags)
+		}
+
+		if *clocksource != "" {
+			args, err = withClocksource(args, *clocksource)
+			if err != nil {
+				panic(err)
+			}
+		}
+
+		if len(kernelArgOverrides) != 0 {
+			args, err = withKernelArgs(args, kernelArgOverrides)
+			if err != nil {
+				panic(err)
+			}
+		}
+		log.Debugf("Guest kernel args: %s", args)
+
+		if *scriptPath != "" {
+			summary.operation("script")
+			if runScript(*scriptPath, args, opts, *continueOnError) != 0 {
+				return exitFailure
+			}
+			return exitOK
+		}
 
-	launchVM(*socketPath)
+		summary.operation("boot")
+		for restarts := 0; launchVM(*socketPath, args, opts); restarts++ {
+			switch opts.onPanic {
+			case "restart":
+				if restarts == maxPanicRestarts {
+					log.Errorf("Guest panicked %d times, giving up", restarts+1)
+					return *panicExitCode
+				}
+				log.Info("Restarting the guest after a panic")
+			case "restore-snapshot":
+				log.Infof("Restoring snapshot %s after a panic", opts.panicSnapshot)
+				return loadSnapshot(*socketPath, opts.panicSnapshot, opts)
+			default:
+				return *panicExitCode
+			}
+		}
+		return exitOK
+	})
 }
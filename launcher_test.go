@@ -0,0 +1,51 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestVMConfigMMDS(t *testing.T) {
+	opts := vmOptions{netNS: "vm1", tapName: "tap0", mac: "02:fc:00:00:00:01"}
+	cfg := vmConfig("/tmp/vm1.sock", "console=ttyS0", opts)
+	if len(cfg.NetworkInterfaces) != 1 {
+		t.Fatalf("got %d network interfaces, want 1", len(cfg.NetworkInterfaces))
+	}
+	iface := cfg.NetworkInterfaces[0]
+	if !iface.AllowMMDS {
+		t.Error("MMDS not allowed on the guest network interface")
+	}
+	if s := iface.StaticConfiguration; s == nil || s.HostDevName != "tap0" || s.MacAddress != opts.mac {
+		t.Errorf("unexpected network interface %+v", s)
+	}
+
+	if cfg := vmConfig("/tmp/vm1.sock", "console=ttyS0", vmOptions{}); len(cfg.NetworkInterfaces) != 0 {
+		t.Errorf("network interface added without -netns")
+	}
+}
+
+func TestCheckMMDS(t *testing.T) {
+	saved := captureDmesg
+	defer func() { captureDmesg = saved }()
+
+	if err := checkMMDS(vmOptions{}); err != nil {
+		t.Errorf("refused without guest agent features: %v", err)
+	}
+
+	captureDmesg = true
+	opts := vmOptions{warmupIO: []string{"/usr/lib"}}
+	err := checkMMDS(opts)
+	if err == nil {
+		t.Fatal("guest agent features accepted without a network interface")
+	}
+	for _, flag := range []string{"-capture-dmesg", "-warmup-io"} {
+		if !strings.Contains(err.Error(), flag) {
+			t.Errorf("error %q doesn't name %s", err, flag)
+		}
+	}
+
+	opts.netNS = "vm1"
+	if err := checkMMDS(opts); err != nil {
+		t.Errorf("refused with -netns: %v", err)
+	}
+}
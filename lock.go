@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Held by the launcher that started the VM behind socketPath, for as long
+// as its VMM runs
+func lockPath(socketPath string) string {
+	return socketPath + ".lock"
+}
+
+// Held while the VM is snapshotted or replaced, one operation at a time
+func opLockPath(socketPath string) string {
+	return socketPath + ".op.lock"
+}
+
+func processAlive(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	return err == nil || err == syscall.EPERM
+}
+
+// Take the lock file at path of the VM behind socketPath for this launcher,
+// verb says in errors what its owner does with the VM. A lock whose owner
+// is gone is only taken over with force. Returns a function that releases
+// the lock.
+func acquireLock(path string, socketPath string, verb string, force bool) (func(), error) {
+	pid := os.Getpid()
+
+	for {
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err == nil {
+			_, err = fmt.Fprintln(f, pid)
+			f.Close()
+			if err != nil {
+				os.Remove(path)
+				return nil, err
+			}
+			registerPath("lock file", path)
+			return func() { releaseLock(path, pid) }, nil
+		}
+		if !os.IsExist(err) {
+			return nil, err
+		}
+
+		data, err := ioutil.ReadFile(path)
+		if os.IsNotExist(err) {
+			// Released in the meantime
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		owner, err := strconv.Atoi(strings.TrimSpace(string(data)))
+		switch {
+		case err != nil:
+			if !force {
+				return nil, fmt.Errorf("invalid lock file %s, use -force to take it over", path)
+			}
+		case processAlive(owner):
+			return nil, fmt.Errorf("VM on %s already %s by pid %d", socketPath, verb, owner)
+		case !force:
+			return nil, fmt.Errorf("VM on %s was %s by pid %d, which is gone, use -force to take over", socketPath, verb, owner)
+		}
+
+		log.Warnf("Taking over stale lock %s", path)
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+}
+
+// Take the lock of the VM behind socketPath for an operation that changes
+// it, returning the function that releases it.
+func lockVM(socketPath string, force bool) func() {
+	unlock, err := acquireLock(opLockPath(socketPath), socketPath, "being changed", force)
+	if err != nil {
+		panic(err)
+	}
+	return unlock
+}
+
+// Take the lock of socketPath for a VMM this launcher starts on it, before
+// a stale socket is removed, returning the function that releases it.
+func manageVM(socketPath string, force bool) func() {
+	unlock, err := acquireLock(lockPath(socketPath), socketPath, "managed", force)
+	if err != nil {
+		panic(err)
+	}
+	return unlock
+}
+
+// Marker a hot upgrade leaves before it stops the VMM behind socketPath, so
+// that the launcher that started it takes the exit as a clean stop
+func handoverPath(socketPath string) string {
+	return socketPath + ".handover"
+}
+
+// Tell the launcher managing the VM behind socketPath that its VMM pid is
+// about to be stopped on purpose.
+func markHandover(socketPath string, pid int) error {
+	path := handoverPath(socketPath)
+	registerPath("handover marker", path)
+	return ioutil.WriteFile(path, []byte(strconv.Itoa(pid)+"\n"), 0644)
+}
+
+// Whether the VMM pid behind socketPath was handed over to another launcher,
+// removing the marker if so.
+func handedOver(socketPath string, pid int) bool {
+	path := handoverPath(socketPath)
+	data, err := ioutil.ReadFile(path)
+	if err != nil || strings.TrimSpace(string(data)) != strconv.Itoa(pid) {
+		return false
+	}
+	os.Remove(path)
+	log.Infof("VMM %d handed over by a hot upgrade", pid)
+	return true
+}
+
+// Remove the lock file, unless someone else took it over.
+func releaseLock(path string, pid int) {
+	data, err := ioutil.ReadFile(path)
+	if err == nil && strings.TrimSpace(string(data)) == strconv.Itoa(pid) {
+		os.Remove(path)
+	}
+}
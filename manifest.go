@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	firecracker "github.com/firecracker-microvm/firecracker-go-sdk"
+)
+
+// Description of a snapshot, stored next to it as <snapshot>.json
+type snapshotManifest struct {
+	MemSizeMib   int64     `json:"mem_size_mib"`
+	VcpuCount    int64     `json:"vcpu_count"`
+	SnapshotType string    `json:"snapshot_type"`
+	CreatedAt    time.Time `json:"created_at"`
+	MemFileSize  int64     `json:"mem_file_size"`
+	MemSHA256    string    `json:"mem_sha256"`
+	// Where the snapshot was taken, nil with -no-host-info
+	Host *hostInfo `json:"host,omitempty"`
+}
+
+// The host a snapshot was taken on, for debugging restores on other hosts
+type hostInfo struct {
+	CPUModel           string `json:"cpu_model,omitempty"`
+	Microcode          string `json:"microcode,omitempty"`
+	KernelVersion      string `json:"kernel_version,omitempty"`
+	FirecrackerVersion string `json:"firecracker_version,omitempty"`
+}
+
+// Whether newManifest records hostInfo, cleared by -no-host-info
+var recordHostInfo = true
+
+// Describe the host and the Firecracker serving socketPath. Fields that
+// can't be read are left empty.
+func readHostInfo(socketPath string) *hostInfo {
+	info := &hostInfo{}
+
+	if cpuinfo, err := ioutil.ReadFile("/proc/cpuinfo"); err == nil {
+		for _, line := range strings.Split(string(cpuinfo), "\n") {
+			kv := strings.SplitN(line, ":", 2)
+			if len(kv) != 2 {
+				continue
+			}
+			key, value := strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1])
+			switch {
+			case key == "model name" && info.CPUModel == "":
+				info.CPUModel = value
+			case key == "microcode" && info.Microcode == "":
+				info.Microcode = value
+			}
+		}
+	}
+
+	if release, err := ioutil.ReadFile("/proc/sys/kernel/osrelease"); err == nil {
+		info.KernelVersion = strings.TrimSpace(string(release))
+	}
+
+	// Ask the binary that is actually running, not the one in the config
+	if pid, err := findVMMPid(socketPath); err == nil {
+		if out, err := runTool(fmt.Sprintf("/proc/%d/exe", pid), "--version"); err == nil {
+			info.FirecrackerVersion = strings.SplitN(out, "\n", 2)[0]
+		}
+	}
+	if info.FirecrackerVersion == "" {
+		log.Warnf("Could not get the Firecracker version for %s", socketPath)
+	}
+	return info
+}
+
+func manifestPath(snapshotPath string) string {
+	return snapshotPath + ".json"
+}
+
+// Build the manifest of a snapshot taken from the VM behind socketPath.
+func newManifest(socketPath string, snapshotPath string, snapshotType string) (*snapshotManifest, error) {
+	client := newAPIClient(socketPath)
+	resp, err := client.GetMachineConfiguration()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get machine configuration: %v", err)
+	}
+
+	sum, size, err := hashFile(snapshotPath + ".mem")
+	if err != nil {
+		return nil, fmt.Errorf("failed to checksum memory file: %v", err)
+	}
+
+	m := &snapshotManifest{
+		MemSizeMib:   firecracker.Int64Value(resp.Payload.MemSizeMib),
+		VcpuCount:    firecracker.Int64Value(resp.Payload.VcpuCount),
+		SnapshotType: snapshotType,
+		CreatedAt:    time.Now().UTC(),
+		MemFileSize:  size,
+		MemSHA256:    sum,
+	}
+	if recordHostInfo {
+		m.Host = readHostInfo(socketPath)
+	}
+	return m, nil
+}
+
+func writeManifest(snapshotPath string, m *snapshotManifest) error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(manifestPath(snapshotPath), append(data, '\n'), 0644)
+}
+
+// Read the manifest of a snapshot. Returns nil without an error if the
+// snapshot has no manifest.
+func readManifest(snapshotPath string) (*snapshotManifest, error) {
+	data, err := ioutil.ReadFile(manifestPath(snapshotPath))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var m snapshotManifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("invalid manifest %s: %v", manifestPath(snapshotPath), err)
+	}
+	return &m, nil
+}
+
+// Return the MemAvailable value of /proc/meminfo in MiB.
+func hostAvailableMemoryMib() (int64, error) {
+	f, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || fields[0] != "MemAvailable:" {
+			continue
+		}
+		kb, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return 0, err
+		}
+		return kb / 1024, nil
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+	return 0, fmt.Errorf("MemAvailable not found in /proc/meminfo")
+}
+
+// Make sure the host has enough memory available to restore the snapshot.
+// With allowOvercommit set a shortage is only reported.
+func checkRestoreMemory(snapshotPath string, allowOvercommit bool) error {
+	m, err := readManifest(snapshotPath)
+	if err != nil {
+		return err
+	}
+	if m == nil {
+		log.Warnf("No manifest for snapshot %s, skipping memory check", snapshotPath)
+		return nil
+	}
+
+	available, err := hostAvailableMemoryMib()
+	if err != nil {
+		return fmt.Errorf("failed to read host memory: %v", err)
+	}
+
+	if m.MemSizeMib <= available {
+		return nil
+	}
+
+	msg := fmt.Sprintf("snapshot %s needs %d MiB of guest memory but the host only has %d MiB available",
+		snapshotPath, m.MemSizeMib, available)
+	if allowOvercommit {
+		log.Warnf("%s, restoring anyway", msg)
+		return nil
+	}
+	return fmt.Errorf("%s (use -allow-overcommit to restore anyway)", msg)
+}
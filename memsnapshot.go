@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	firecracker "github.com/firecracker-microvm/firecracker-go-sdk"
+)
+
+// What -snapshot-at-mem does after the snapshot
+var memSnapshotActions = []string{"exit", "continue"}
+
+func validateMemSnapshotAction(action string) error {
+	for _, a := range memSnapshotActions {
+		if a == action {
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown -snapshot-at-mem-then action %q", action)
+}
+
+// Poll the balloon statistics of the guest every interval, the returned
+// channel is closed once its used memory exceeds threshold bytes. Stops
+// polling when ctx is done.
+func watchGuestMem(ctx context.Context, machine *firecracker.Machine, threshold int64, interval time.Duration) <-chan struct{} {
+	reached := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+			stats, err := machine.GetBalloonStats(ctx)
+			// No statistics until the guest's balloon driver sent some
+			if err != nil || stats.TotalMemory == 0 {
+				continue
+			}
+			if stats.TotalMemory-stats.AvailableMemory > threshold {
+				close(reached)
+				return
+			}
+		}
+	}()
+	return reached
+}
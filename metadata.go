@@ -0,0 +1,23 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+)
+
+// Read a -metadata file. MMDS only takes a JSON object at the top level.
+func readMetadata(path string) (map[string]interface{}, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var metadata map[string]interface{}
+	if err := json.Unmarshal(data, &metadata); err != nil {
+		return nil, fmt.Errorf("invalid MMDS data in %s, expected a JSON object: %v", path, err)
+	}
+	if metadata == nil {
+		return nil, fmt.Errorf("invalid MMDS data in %s, expected a JSON object, got null", path)
+	}
+	return metadata, nil
+}
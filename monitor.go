@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	firecracker "github.com/firecracker-microvm/firecracker-go-sdk"
+	models "github.com/firecracker-microvm/firecracker-go-sdk/client/models"
+)
+
+// Find the pid of the Firecracker process serving socketPath.
+func findVMMPid(socketPath string) (int, error) {
+	want, err := filepath.Abs(socketPath)
+	if err != nil {
+		return 0, err
+	}
+
+	procs, err := filepath.Glob("/proc/[0-9]*")
+	if err != nil {
+		return 0, err
+	}
+	for _, proc := range procs {
+		cmdline, err := ioutil.ReadFile(filepath.Join(proc, "cmdline"))
+		if err != nil {
+			continue
+		}
+		args := strings.Split(string(cmdline), "\x00")
+		for i := 0; i+1 < len(args); i++ {
+			if args[i] != "--api-sock" {
+				continue
+			}
+			sock := args[i+1]
+			if !filepath.IsAbs(sock) {
+				// Relative to the working directory of that process
+				cwd, err := os.Readlink(filepath.Join(proc, "cwd"))
+				if err != nil {
+					continue
+				}
+				sock = filepath.Join(cwd, sock)
+			}
+			if sock == want {
+				return strconv.Atoi(filepath.Base(proc))
+			}
+		}
+	}
+	return 0, fmt.Errorf("no Firecracker process found for socket %s", socketPath)
+}
+
+// Statistics of the VMM process as seen from the host
+type hostStats struct {
+	Pid        int     `json:"pid"`
+	RssKib     int64   `json:"rss_kib"`
+	CPUSeconds float64 `json:"cpu_seconds"`
+}
+
+// Clock ticks per second for /proc/<pid>/stat, USER_HZ is 100 on Linux
+const userHZ = 100
+
+func readHostStats(pid int) (*hostStats, error) {
+	stats := &hostStats{Pid: pid}
+
+	status, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/status", pid))
+	if err != nil {
+		return nil, err
+	}
+	for _, line := range strings.Split(string(status), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) >= 2 && fields[0] == "VmRSS:" {
+			stats.RssKib, _ = strconv.ParseInt(fields[1], 10, 64)
+		}
+	}
+
+	stat, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return nil, err
+	}
+	// The command name can contain spaces, fields are counted after it
+	fields := strings.Fields(string(stat[strings.LastIndexByte(string(stat), ')')+1:]))
+	if len(fields) > 12 {
+		utime, _ := strconv.ParseInt(fields[11], 10, 64)
+		stime, _ := strconv.ParseInt(fields[12], 10, 64)
+		stats.CPUSeconds = float64(utime+stime) / userHZ
+	}
+	return stats, nil
+}
+
+// One line of -monitor output
+type monitorSample struct {
+	Time    time.Time            `json:"time"`
+	Host    *hostStats           `json:"host,omitempty"`
+	Balloon *models.BalloonStats `json:"balloon,omitempty"`
+	Metrics interface{}          `json:"metrics,omitempty"`
+}
+
+// Print a JSON line with host, balloon and MMDS published metrics of the
+// VM behind socketPath every interval, until interrupted.
+// Balloon stats and metrics are left out when the VM doesn't provide them.
+func monitor(socketPath string, interval time.Duration) {
+	ctx := context.Background()
+	cfg := firecracker.Config{SocketPath: socketPath}
+
+	// Keep the SDK quiet about missing balloons on every sample
+	logger := log.New()
+	logger.SetLevel(log.FatalLevel)
+	machine, err := firecracker.NewMachine(ctx, cfg, firecracker.WithClient(newAPIClient(cfg.SocketPath)),
+		firecracker.WithLogger(log.NewEntry(logger)))
+	if err != nil {
+		panic(fmt.Errorf("failed to create new machine: %v", err))
+	}
+
+	pid, err := findVMMPid(socketPath)
+	if err != nil {
+		log.Warnf("Host stats unavailable: %v", err)
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(signals)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	out := json.NewEncoder(os.Stdout)
+	for {
+		sample := monitorSample{Time: time.Now().UTC()}
+		if pid != 0 {
+			if sample.Host, err = readHostStats(pid); err != nil {
+				log.Errorf("VMM process is gone: %v", err)
+				return
+			}
+		}
+		if stats, err := machine.GetBalloonStats(ctx); err == nil {
+			sample.Balloon = &stats
+		}
+		var mmds map[string]interface{}
+		if err := machine.GetMetadata(ctx, &mmds); err == nil {
+			sample.Metrics = mmds["metrics"]
+		}
+		out.Encode(sample)
+
+		select {
+		case <-ticker.C:
+		case <-signals:
+			return
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Where `ip netns` keeps the named network namespace handles
+const netnsDir = "/var/run/netns"
+
+// Derive a stable MAC address from a VM name: the first 6 bytes of the
+// SHA-256 of the name, made a locally administered unicast address.
+func macFromName(name string) string {
+	sum := sha256.Sum256([]byte(name))
+	mac := net.HardwareAddr(sum[:6])
+	mac[0] = mac[0]&^0x01 | 0x02
+	return mac.String()
+}
+
+// Run `ip` with the given arguments, returning its output on failure.
+func runIP(args ...string) error {
+	out, err := exec.Command("ip", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("ip %v: %v: %s", args, err, out)
+	}
+	return nil
+}
+
+// Make sure the named network namespace exists and holds a TAP device for
+// the microVM. The namespace and TAP are created if they are missing.
+// The returned function removes whatever was created here.
+func setupNetNS(name string, tap string) (func(), error) {
+	createdNS := false
+	if _, err := os.Stat(filepath.Join(netnsDir, name)); os.IsNotExist(err) {
+		if err := runIP("netns", "add", name); err != nil {
+			return nil, err
+		}
+		createdNS = true
+		registerNetNS(name)
+		log.Infof("Created network namespace %s", name)
+	}
+
+	cleanup := func() {
+		if createdNS {
+			if err := runIP("netns", "del", name); err != nil {
+				log.Errorf("failed to delete network namespace: %v", err)
+			}
+		}
+	}
+
+	createdTap := false
+	if err := runIP("-n", name, "link", "show", tap); err != nil {
+		if err := runIP("-n", name, "tuntap", "add", "dev", tap, "mode", "tap"); err != nil {
+			cleanup()
+			return nil, err
+		}
+		createdTap = true
+		registerTap(name, tap)
+	}
+
+	if err := runIP("-n", name, "link", "set", tap, "up"); err != nil {
+		cleanup()
+		return nil, err
+	}
+
+	// A deleted namespace takes its TAP along, otherwise remove it by hand
+	if createdTap && !createdNS {
+		cleanup = func() {
+			if err := runIP("-n", name, "link", "del", tap); err != nil {
+				log.Errorf("failed to delete TAP device: %v", err)
+			}
+		}
+	}
+
+	return cleanup, nil
+}
+
+// Make the command run inside the named network namespace.
+// `ip netns exec` execs the command, so the pid stays the same.
+func inNetNS(cmd *exec.Cmd, name string) error {
+	ipPath, err := exec.LookPath("ip")
+	if err != nil {
+		return err
+	}
+
+	cmd.Args = append([]string{"ip", "netns", "exec", name}, cmd.Args...)
+	cmd.Path = ipPath
+	return nil
+}
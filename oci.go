@@ -0,0 +1,305 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Where root filesystems built from OCI images are kept, by image digest
+const ociCacheDir = "oci-cache"
+
+// The subset of the OCI image layout that is needed to unpack an image
+type ociDescriptor struct {
+	MediaType string `json:"mediaType"`
+	Digest    string `json:"digest"`
+}
+
+type ociIndex struct {
+	Manifests []ociDescriptor `json:"manifests"`
+}
+
+type ociManifest struct {
+	Layers []ociDescriptor `json:"layers"`
+}
+
+func runTool(name string, args ...string) (string, error) {
+	out, err := exec.Command(name, args...).Output()
+	if err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			return "", fmt.Errorf("%s %s: %v: %s", name, strings.Join(args, " "), err, exitErr.Stderr)
+		}
+		return "", fmt.Errorf("%s: %v", name, err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// Return the rootfs for the OCI image reference, building it if it isn't
+// cached yet. Needs skopeo to talk to the registry and mkfs.ext4.
+func ociRootfs(ref string) (string, error) {
+	digest, err := runTool("skopeo", "inspect", "--format", "{{.Digest}}", "docker://"+ref)
+	if err != nil {
+		return "", err
+	}
+
+	rootfs := filepath.Join(ociCacheDir, strings.Replace(digest, ":", "-", 1)+".ext4")
+	if _, err := os.Stat(rootfs); err == nil {
+		log.Infof("Using cached rootfs %s for %s", rootfs, ref)
+		return rootfs, nil
+	}
+
+	tmp, err := ioutil.TempDir("", "launcher-oci")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(tmp)
+	registerPath("temporary directory", tmp)
+
+	layout := filepath.Join(tmp, "layout")
+	if _, err := runTool("skopeo", "copy", "docker://"+ref, "oci:"+layout+":image"); err != nil {
+		return "", err
+	}
+
+	root := filepath.Join(tmp, "root")
+	if err := os.Mkdir(root, 0755); err != nil {
+		return "", err
+	}
+	size, err := unpackOCI(layout, root)
+	if err != nil {
+		return "", fmt.Errorf("failed to unpack %s: %v", ref, err)
+	}
+
+	if err := os.MkdirAll(ociCacheDir, 0755); err != nil {
+		return "", err
+	}
+
+	// Build under a temporary name so an interrupted build is never cached
+	partial := rootfs + ".partial"
+	// Leave room for filesystem metadata and some free space
+	imageSize := size + size/2 + 64<<20
+	if err := buildExt4(root, partial, imageSize); err != nil {
+		os.Remove(partial)
+		return "", err
+	}
+	if err := os.Rename(partial, rootfs); err != nil {
+		return "", err
+	}
+
+	log.Infof("Built rootfs %s for %s", rootfs, ref)
+	return rootfs, nil
+}
+
+func buildExt4(root string, path string, size int64) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	err = f.Truncate(size)
+	f.Close()
+	if err != nil {
+		return err
+	}
+
+	_, err = runTool("mkfs.ext4", "-q", "-F", "-d", root, path)
+	return err
+}
+
+func readJSON(path string, v interface{}) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+func blobPath(layout string, digest string) string {
+	return filepath.Join(layout, "blobs", strings.Replace(digest, ":", "/", 1))
+}
+
+// Flatten the layers of the single image in an OCI layout into root.
+// Returns the number of bytes of file data written.
+func unpackOCI(layout string, root string) (int64, error) {
+	var index ociIndex
+	if err := readJSON(filepath.Join(layout, "index.json"), &index); err != nil {
+		return 0, err
+	}
+	if len(index.Manifests) != 1 {
+		return 0, fmt.Errorf("expected one image in the layout, found %d", len(index.Manifests))
+	}
+
+	var manifest ociManifest
+	if err := readJSON(blobPath(layout, index.Manifests[0].Digest), &manifest); err != nil {
+		return 0, err
+	}
+
+	var total int64
+	for _, layer := range manifest.Layers {
+		n, err := applyLayer(blobPath(layout, layer.Digest), layer.MediaType, root)
+		if err != nil {
+			return 0, fmt.Errorf("layer %s: %v", layer.Digest, err)
+		}
+		total += n
+	}
+	return total, nil
+}
+
+// Resolve a path from a layer inside root, refusing to go through
+// symlinks so that an image can't write outside of root.
+func layerPath(root string, name string) (string, error) {
+	clean := filepath.Clean("/" + name)
+	path := root
+	parts := strings.Split(strings.TrimPrefix(clean, "/"), "/")
+	for i, part := range parts {
+		if part == "" {
+			continue
+		}
+		path = filepath.Join(path, part)
+		if i == len(parts)-1 {
+			break
+		}
+		if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSymlink != 0 {
+			return "", fmt.Errorf("%s goes through a symlink", name)
+		}
+	}
+	return path, nil
+}
+
+// Apply one layer tarball on top of root, handling whiteouts.
+func applyLayer(blob string, mediaType string, root string) (int64, error) {
+	f, err := os.Open(blob)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+	switch {
+	case strings.HasSuffix(mediaType, "+gzip") || strings.HasSuffix(mediaType, ".gzip"):
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return 0, err
+		}
+		defer gz.Close()
+		r = gz
+	case strings.HasSuffix(mediaType, "tar"):
+	default:
+		return 0, fmt.Errorf("unsupported layer media type %s", mediaType)
+	}
+
+	var total int64
+	// Paths this layer put in root, and their parent directories, kept by
+	// opaque whiteouts
+	added := map[string]bool{}
+	parents := map[string]bool{}
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return total, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+
+		path, err := layerPath(root, hdr.Name)
+		if err != nil {
+			return 0, err
+		}
+		dir, base := filepath.Split(path)
+
+		// Opaque directory: drop what the lower layers put there
+		if base == ".wh..wh..opq" {
+			removeLower(filepath.Clean(dir), added, parents)
+			continue
+		}
+		if strings.HasPrefix(base, ".wh.") {
+			os.RemoveAll(filepath.Join(dir, strings.TrimPrefix(base, ".wh.")))
+			continue
+		}
+
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return 0, err
+		}
+		mode := os.FileMode(hdr.Mode).Perm()
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			// Chmod follows symlinks, replace whatever isn't a directory
+			if info, err := os.Lstat(path); err == nil && !info.IsDir() {
+				if err := os.Remove(path); err != nil {
+					return 0, err
+				}
+			}
+			if err := os.MkdirAll(path, mode); err != nil {
+				return 0, err
+			}
+			os.Chmod(path, mode)
+		case tar.TypeReg, tar.TypeRegA:
+			os.RemoveAll(path)
+			out, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode)
+			if err != nil {
+				return 0, err
+			}
+			n, err := io.Copy(out, tr)
+			out.Close()
+			if err != nil {
+				return 0, err
+			}
+			total += n
+		case tar.TypeSymlink:
+			os.RemoveAll(path)
+			if err := os.Symlink(hdr.Linkname, path); err != nil {
+				return 0, err
+			}
+		case tar.TypeLink:
+			target, err := layerPath(root, hdr.Linkname)
+			if err != nil {
+				return 0, err
+			}
+			os.RemoveAll(path)
+			if err := os.Link(target, path); err != nil {
+				return 0, err
+			}
+		default:
+			// Device nodes and fifos are created by the guest's init
+			log.Debugf("Skipping %s of type %c", hdr.Name, hdr.Typeflag)
+			continue
+		}
+
+		// Keep ownership when running as root, mkfs.ext4 -d copies it
+		if os.Geteuid() == 0 {
+			os.Lchown(path, hdr.Uid, hdr.Gid)
+		}
+
+		added[path] = true
+		for p := filepath.Dir(path); strings.HasPrefix(p, root+"/") && !parents[p]; p = filepath.Dir(p) {
+			parents[p] = true
+		}
+	}
+}
+
+// Remove what the lower layers put in dir, keeping what the current layer
+// added.
+func removeLower(dir string, added map[string]bool, parents map[string]bool) {
+	entries, _ := ioutil.ReadDir(dir)
+	for _, e := range entries {
+		path := filepath.Join(dir, e.Name())
+		switch {
+		case added[path] && !e.IsDir():
+		case added[path] || parents[path]:
+			// Only what the lower layers put under it goes
+			removeLower(path, added, parents)
+		default:
+			os.RemoveAll(path)
+		}
+	}
+}
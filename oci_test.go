@@ -0,0 +1,123 @@
+package main
+
+import (
+	"archive/tar"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const testLayerType = "application/vnd.oci.image.layer.v1.tar"
+
+// An entry of a test layer, a directory when name ends with a slash
+type testEntry struct {
+	name     string
+	linkname string
+	mode     int64
+}
+
+func writeLayer(t *testing.T, entries ...testEntry) string {
+	f, err := ioutil.TempFile(t.TempDir(), "layer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	tw := tar.NewWriter(f)
+	for _, e := range entries {
+		hdr := &tar.Header{Name: e.name, Mode: e.mode, Typeflag: tar.TypeReg}
+		switch {
+		case e.linkname != "":
+			hdr.Typeflag = tar.TypeSymlink
+			hdr.Linkname = e.linkname
+		case e.name[len(e.name)-1] == '/':
+			hdr.Typeflag = tar.TypeDir
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return f.Name()
+}
+
+func applyLayers(t *testing.T, root string, layers ...string) {
+	for _, layer := range layers {
+		if _, err := applyLayer(layer, testLayerType, root); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// A directory entry over a symlink mustn't chmod where the symlink points
+func TestApplyLayerDirOverSymlink(t *testing.T) {
+	root := t.TempDir()
+	outside := t.TempDir()
+	if err := os.Chmod(outside, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	applyLayers(t, root, writeLayer(t,
+		testEntry{name: "x", linkname: outside, mode: 0777},
+		testEntry{name: "x/", mode: 0700},
+	))
+
+	if info, err := os.Stat(outside); err != nil || info.Mode().Perm() != 0755 {
+		t.Errorf("directory outside the rootfs changed: %v, %v", info.Mode(), err)
+	}
+	info, err := os.Lstat(filepath.Join(root, "x"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.IsDir() || info.Mode().Perm() != 0700 {
+		t.Errorf("x is %v, want a 0700 directory", info.Mode())
+	}
+}
+
+func TestApplyLayerOpaqueWhiteout(t *testing.T) {
+	for _, c := range []struct {
+		name  string
+		upper []testEntry
+	}{
+		{"whiteout first", []testEntry{
+			{name: "d/", mode: 0755},
+			{name: "d/.wh..wh..opq"},
+			{name: "d/new", mode: 0644},
+			{name: "d/sub/new", mode: 0644},
+		}},
+		// Nothing in the OCI spec orders the whiteout before the entries
+		{"whiteout last", []testEntry{
+			{name: "d/", mode: 0755},
+			{name: "d/new", mode: 0644},
+			{name: "d/sub/new", mode: 0644},
+			{name: "d/.wh..wh..opq"},
+		}},
+	} {
+		root := t.TempDir()
+		applyLayers(t, root,
+			writeLayer(t,
+				testEntry{name: "d/", mode: 0755},
+				testEntry{name: "d/old", mode: 0644},
+				testEntry{name: "d/sub/", mode: 0755},
+				testEntry{name: "d/sub/old", mode: 0644},
+				testEntry{name: "other", mode: 0644},
+			),
+			writeLayer(t, c.upper...),
+		)
+
+		for path, want := range map[string]bool{
+			"d/old":     false,
+			"d/sub/old": false,
+			"d/new":     true,
+			"d/sub/new": true,
+			"other":     true,
+		} {
+			_, err := os.Lstat(filepath.Join(root, path))
+			if got := err == nil; got != want {
+				t.Errorf("%s: %s exists: %v, want %v", c.name, path, got, want)
+			}
+		}
+	}
+}
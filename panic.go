@@ -0,0 +1,36 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	// What the guest kernel prints when it panics
+	guestPanicPattern = "Kernel panic - not syncing"
+	// How many times -on-panic restart relaunches the guest
+	maxPanicRestarts = 5
+)
+
+// Actions accepted by -on-panic
+var panicActions = []string{"restore-snapshot", "restart", "exit-with-code", "capture-snapshot"}
+
+func validatePanicAction(action string, snapshotPath string) error {
+	if action == "" {
+		return nil
+	}
+
+	valid := false
+	for _, a := range panicActions {
+		valid = valid || a == action
+	}
+	if !valid {
+		return fmt.Errorf("unknown -on-panic action %q, expected one of %s",
+			action, strings.Join(panicActions, ", "))
+	}
+
+	if (action == "restore-snapshot" || action == "capture-snapshot") && snapshotPath == "" {
+		return fmt.Errorf("-on-panic %s needs -panic-snapshot", action)
+	}
+	return nil
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Resolve the paths in place against the working directory, leaving empty
+// ones alone. Absolute paths keep working when Firecracker runs from
+// somewhere else, e.g. under the jailer or in a network namespace.
+func makeAbsolute(paths ...*string) error {
+	for _, path := range paths {
+		if *path == "" {
+			continue
+		}
+		abs, err := filepath.Abs(*path)
+		if err != nil {
+			return fmt.Errorf("failed to resolve %s: %v", *path, err)
+		}
+		*path = abs
+	}
+	return nil
+}
+
+// Make sure all the given files exist.
+func requireFiles(paths ...string) error {
+	for _, path := range paths {
+		if _, err := os.Stat(path); err != nil {
+			return fmt.Errorf("required file missing: %v", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMakeAbsolute(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	relative := "snapshots/base"
+	nested := "./a/../b.sock"
+	absolute := "/tmp/base"
+	empty := ""
+	if err := makeAbsolute(&relative, &nested, &absolute, &empty); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		got, want string
+	}{
+		{relative, filepath.Join(wd, "snapshots/base")},
+		{nested, filepath.Join(wd, "b.sock")},
+		{absolute, "/tmp/base"},
+		// Left alone, flags that aren't set stay unset
+		{empty, ""},
+	} {
+		if c.got != c.want {
+			t.Errorf("got %q, want %q", c.got, c.want)
+		}
+	}
+}
+
+// A ~ is the shell's to expand, not a home directory here
+func TestMakeAbsoluteTilde(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := "~/base"
+	if err := makeAbsolute(&path); err != nil {
+		t.Fatal(err)
+	}
+	if want := filepath.Join(wd, "~/base"); path != want {
+		t.Errorf("got %q, want %q", path, want)
+	}
+}
+
+func TestRequireFiles(t *testing.T) {
+	dir := t.TempDir()
+	present := filepath.Join(dir, "vmlinux")
+	if err := ioutil.WriteFile(present, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := requireFiles(present); err != nil {
+		t.Errorf("existing file: %v", err)
+	}
+
+	missing := filepath.Join(dir, "rootfs.ext4")
+	err := requireFiles(present, missing)
+	if err == nil {
+		t.Fatal("no error for a missing file")
+	}
+	if !strings.Contains(err.Error(), missing) {
+		t.Errorf("error %q doesn't name %s", err, missing)
+	}
+}
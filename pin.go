@@ -0,0 +1,28 @@
+package main
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// Lock the pages of a file in the page cache so restoring from it never
+// reads the disk. Returns the number of bytes pinned and a function that
+// unpins them.
+func pinFile(path string) (int64, func(), error) {
+	data, unmap, err := mapFile(path)
+	if err != nil {
+		return 0, nil, err
+	}
+	// Faults every page in, then keeps it resident
+	if err := syscall.Mlock(data); err != nil {
+		unmap()
+		if err == syscall.ENOMEM || err == syscall.EPERM {
+			return 0, nil, fmt.Errorf("failed to lock %s in memory, check ulimit -l: %v", path, err)
+		}
+		return 0, nil, fmt.Errorf("failed to lock %s in memory: %v", path, err)
+	}
+	return int64(len(data)), func() {
+		syscall.Munlock(data)
+		unmap()
+	}, nil
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	_ "net/http/pprof"
+	"os"
+	"runtime"
+	"runtime/pprof"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Start the requested profilers for the launcher process.
+// The returned function stops them and writes out the profile files,
+// it must run on every exit path for the profiles to be complete.
+func startProfiling(pprofAddr string, cpuProfile string, memProfile string) (func(), error) {
+	if pprofAddr != "" {
+		go func() {
+			log.Infof("Serving pprof on http://%s/debug/pprof/", pprofAddr)
+			if err := http.ListenAndServe(pprofAddr, nil); err != nil {
+				log.Errorf("pprof server failed: %v", err)
+			}
+		}()
+	}
+
+	var cpuFile *os.File
+	if cpuProfile != "" {
+		f, err := os.Create(cpuProfile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create CPU profile: %v", err)
+		}
+		if err := pprof.StartCPUProfile(f); err != nil {
+			f.Close()
+			return nil, fmt.Errorf("failed to start CPU profile: %v", err)
+		}
+		cpuFile = f
+	}
+
+	stop := func() {
+		if cpuFile != nil {
+			pprof.StopCPUProfile()
+			cpuFile.Close()
+		}
+
+		if memProfile != "" {
+			f, err := os.Create(memProfile)
+			if err != nil {
+				log.Errorf("failed to create memory profile: %v", err)
+				return
+			}
+			defer f.Close()
+
+			// Get up-to-date statistics
+			runtime.GC()
+			if err := pprof.WriteHeapProfile(f); err != nil {
+				log.Errorf("failed to write memory profile: %v", err)
+			}
+		}
+	}
+
+	return stop, nil
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Restores measured by -profile-host, after one warm-up restore. Fixed so
+// that reports of different hosts compare.
+const profileHostRuns = 20
+
+// Version of the -profile-host report layout
+const hostProfileVersion = 1
+
+// Where the snapshot files are read from
+type storageInfo struct {
+	Filesystem string `json:"filesystem"`
+	// Block device, empty for filesystems without one such as tmpfs
+	Device     string `json:"device,omitempty"`
+	Model      string `json:"model,omitempty"`
+	Rotational *bool  `json:"rotational,omitempty"`
+}
+
+type latencyStats struct {
+	P50 float64 `json:"p50_ms"`
+	P99 float64 `json:"p99_ms"`
+	Min float64 `json:"min_ms"`
+	Max float64 `json:"max_ms"`
+}
+
+// The -profile-host report
+type hostProfile struct {
+	Version  int       `json:"version"`
+	Time     time.Time `json:"time"`
+	Hostname string    `json:"hostname"`
+	Arch     string    `json:"arch"`
+	CPUs     int       `json:"cpus"`
+	MemMib   int64     `json:"mem_available_mib"`
+	*hostInfo
+	Storage     storageInfo `json:"storage"`
+	Snapshot    string      `json:"snapshot"`
+	MemFileSize int64       `json:"mem_file_size"`
+	Runs        int         `json:"runs"`
+	// From starting the VMM until the guest runs
+	Restore      latencyStats `json:"restore"`
+	LoadSnapshot latencyStats `json:"load_snapshot"`
+	// Missing without -ready-pattern
+	GuestReady *latencyStats `json:"guest_ready,omitempty"`
+}
+
+// Filesystem magic numbers, from statfs(2)
+var fsNames = map[int64]string{
+	0xef53:     "ext4",
+	0x58465342: "xfs",
+	0x9123683e: "btrfs",
+	0x01021994: "tmpfs",
+	0x794c7630: "overlay",
+	0x6969:     "nfs",
+	0x2fc12fc1: "zfs",
+}
+
+// Describe the filesystem and block device holding path.
+func readStorageInfo(path string) storageInfo {
+	info := storageInfo{Filesystem: "unknown"}
+	var fs syscall.Statfs_t
+	if err := syscall.Statfs(path, &fs); err == nil {
+		if name, ok := fsNames[int64(fs.Type)]; ok {
+			info.Filesystem = name
+		} else {
+			info.Filesystem = fmt.Sprintf("%#x", fs.Type)
+		}
+	}
+
+	var st syscall.Stat_t
+	if err := syscall.Stat(path, &st); err != nil {
+		return info
+	}
+	major := (st.Dev>>8)&0xfff | (st.Dev>>32)&^0xfff
+	minor := st.Dev&0xff | (st.Dev>>12)&^0xff
+	dir, err := filepath.EvalSymlinks(fmt.Sprintf("/sys/dev/block/%d:%d", major, minor))
+	if err != nil {
+		return info
+	}
+	info.Device = filepath.Base(dir)
+	// A partition has the queue and device of its disk
+	read := func(name string) string {
+		for _, d := range []string{dir, filepath.Dir(dir)} {
+			if data, err := ioutil.ReadFile(filepath.Join(d, name)); err == nil {
+				return strings.TrimSpace(string(data))
+			}
+		}
+		return ""
+	}
+	info.Model = read("device/model")
+	if r := read("queue/rotational"); r != "" {
+		rotational := r == "1"
+		info.Rotational = &rotational
+	}
+	return info
+}
+
+// Nearest-rank statistics of the given latencies, sorted in place.
+func newLatencyStats(d []time.Duration) latencyStats {
+	sort.Slice(d, func(i, j int) bool { return d[i] < d[j] })
+	ms := func(d time.Duration) float64 {
+		return float64(d) / float64(time.Millisecond)
+	}
+	rank := func(p int) time.Duration {
+		return d[(len(d)*p+99)/100-1]
+	}
+	return latencyStats{P50: ms(rank(50)), P99: ms(rank(99)), Min: ms(d[0]), Max: ms(d[len(d)-1])}
+}
+
+// Restore snapshotPath profileHostRuns times on socketPath and print a JSON
+// report of the host and the restore latencies, meant to be collected from
+// several hosts and compared.
+func profileHost(socketPath string, snapshotPath string, opts vmOptions) {
+	// The restored VMs are stopped right away, they don't need the terminal
+	opts.detached = true
+
+	report := &hostProfile{
+		Version:  hostProfileVersion,
+		Time:     time.Now().UTC(),
+		Arch:     hostArch(),
+		CPUs:     runtime.NumCPU(),
+		Storage:  readStorageInfo(snapshotPath + ".mem"),
+		Snapshot: snapshotPath,
+		Runs:     profileHostRuns,
+	}
+	report.Hostname, _ = os.Hostname()
+	report.MemMib, _ = hostAvailableMemoryMib()
+	if info, err := os.Stat(snapshotPath + ".mem"); err == nil {
+		report.MemFileSize = info.Size()
+	}
+
+	var restore, load, ready []time.Duration
+	for i := 0; i <= profileHostRuns; i++ {
+		vm := restoreVM(socketPath, snapshotPath, opts)
+		err := resumeRestored(vm, opts)
+		if i == 0 {
+			// The running VMM tells its own version
+			report.hostInfo = readHostInfo(socketPath)
+		}
+		vm.stop()
+		if err != nil {
+			panic(fmt.Errorf("restore %d failed: %v", i, err))
+		}
+		// The first run only warms up the caches
+		if i == 0 {
+			continue
+		}
+		p := vm.phases
+		restore = append(restore, p.processStart+p.socketWait+p.loadSnapshot+p.resume)
+		load = append(load, p.loadSnapshot)
+		if p.guestReady != 0 {
+			ready = append(ready, p.guestReady)
+		}
+	}
+
+	summary.latencies("restore", restore)
+	summary.latencies("load_snapshot", load)
+	summary.latencies("guest_ready", ready)
+	summary.size("mem_file", report.MemFileSize)
+
+	report.Restore = newLatencyStats(restore)
+	report.LoadSnapshot = newLatencyStats(load)
+	if len(ready) == profileHostRuns {
+		stats := newLatencyStats(ready)
+		report.GuestReady = &stats
+	}
+
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		panic(err)
+	}
+	fmt.Println(string(data))
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// A pseudo-terminal pair. The VMM gets the master side, the user attaches
+// to the slave side through its /dev/pts path.
+type pty struct {
+	master *os.File
+	slave  *os.File
+	path   string
+}
+
+func ioctl(fd uintptr, req uintptr, arg uintptr) error {
+	_, err := ioctlValue(fd, req, arg)
+	return err
+}
+
+// For the ioctls returning a value, like the KVM ones.
+func ioctlValue(fd uintptr, req uintptr, arg uintptr) (uintptr, error) {
+	r, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, req, arg)
+	if errno != 0 {
+		return 0, errno
+	}
+	return r, nil
+}
+
+func getTermios(fd uintptr) (*syscall.Termios, error) {
+	var t syscall.Termios
+	if err := ioctl(fd, syscall.TCGETS, uintptr(unsafe.Pointer(&t))); err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+func setTermios(fd uintptr, t *syscall.Termios) error {
+	return ioctl(fd, syscall.TCSETS, uintptr(unsafe.Pointer(t)))
+}
+
+// Same as cfmakeraw(3): the guest does its own line discipline.
+func makeRaw(t *syscall.Termios) {
+	t.Iflag &^= syscall.IGNBRK | syscall.BRKINT | syscall.PARMRK | syscall.ISTRIP |
+		syscall.INLCR | syscall.IGNCR | syscall.ICRNL | syscall.IXON
+	t.Oflag &^= syscall.OPOST
+	t.Lflag &^= syscall.ECHO | syscall.ECHONL | syscall.ICANON | syscall.ISIG | syscall.IEXTEN
+	t.Cflag &^= syscall.CSIZE | syscall.PARENB
+	t.Cflag |= syscall.CS8
+	t.Cc[syscall.VMIN] = 1
+	t.Cc[syscall.VTIME] = 0
+}
+
+// Allocate a new pseudo-terminal in raw mode.
+func openPTY() (*pty, error) {
+	master, err := os.OpenFile("/dev/ptmx", os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	var unlock int32
+	if err := ioctl(master.Fd(), syscall.TIOCSPTLCK, uintptr(unsafe.Pointer(&unlock))); err != nil {
+		master.Close()
+		return nil, fmt.Errorf("failed to unlock pty: %v", err)
+	}
+
+	var n uint32
+	if err := ioctl(master.Fd(), syscall.TIOCGPTN, uintptr(unsafe.Pointer(&n))); err != nil {
+		master.Close()
+		return nil, fmt.Errorf("failed to get pty number: %v", err)
+	}
+	path := fmt.Sprintf("/dev/pts/%d", n)
+
+	// Keep the slave open so the VMM doesn't get EIO while nobody is attached
+	slave, err := os.OpenFile(path, os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		master.Close()
+		return nil, err
+	}
+
+	t, err := getTermios(slave.Fd())
+	if err == nil {
+		makeRaw(t)
+		err = setTermios(slave.Fd(), t)
+	}
+	if err != nil {
+		slave.Close()
+		master.Close()
+		return nil, fmt.Errorf("failed to set pty to raw mode: %v", err)
+	}
+
+	return &pty{master: master, slave: slave, path: path}, nil
+}
+
+func (p *pty) Close() {
+	p.slave.Close()
+	p.master.Close()
+}
+
+// Save the settings of the launcher's terminal, if any.
+// The returned function puts them back.
+func saveTerminal() func() {
+	t, err := getTermios(os.Stdin.Fd())
+	if err != nil {
+		// Not a terminal
+		return func() {}
+	}
+	return func() {
+		setTermios(os.Stdin.Fd(), t)
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	firecracker "github.com/firecracker-microvm/firecracker-go-sdk"
+)
+
+// Guest command the agent runs before a snapshot, set by -quiesce-cmd.
+// Empty to snapshot without quiescing.
+var quiesceCmd string
+
+// How long the guest gets to quiesce, set by -quiesce-timeout
+var quiesceTimeout = 10 * time.Second
+
+// Whether the agent runs fstrim before a snapshot, set by
+// -trim-before-snapshot
+var trimBeforeSnapshot bool
+
+// How long the guest gets to trim its filesystems
+const trimTimeout = 30 * time.Second
+
+// MMDS keys the guest agent polls for requests
+const (
+	quiesceKey = "quiesce"
+	trimKey    = "trim"
+)
+
+// The flags of opts and the launcher turning on features the guest agent
+// serves through MMDS.
+func mmdsFlags(opts vmOptions) []string {
+	var flags []string
+	for _, f := range []struct {
+		name string
+		set  bool
+	}{
+		{"-quiesce-cmd", quiesceCmd != ""},
+		{"-trim-before-snapshot", trimBeforeSnapshot},
+		{"-scrub-mem", scrubMemWait > 0},
+		{"-capture-dmesg", captureDmesg},
+		{"-warmup-io", len(opts.warmupIO) != 0},
+		{"-metadata", opts.metadata != nil},
+	} {
+		if f.set {
+			flags = append(flags, f.name)
+		}
+	}
+	return flags
+}
+
+// Make sure the guest of a VM the launcher boots or restores can reach
+// MMDS, which it only does through the network interface of -netns.
+func checkMMDS(opts vmOptions) error {
+	if flags := mmdsFlags(opts); len(flags) != 0 && opts.netNS == "" {
+		return fmt.Errorf("%s need the guest to reach MMDS, through the network interface -netns adds",
+			strings.Join(flags, ", "))
+	}
+	return nil
+}
+
+// A request to the guest agent. The agent sees it under key in MMDS and
+// prints "<key> done <id>" on the console when it's done.
+type guestRequest struct {
+	machine *firecracker.Machine
+	key     string
+	id      string
+	done    <-chan struct{}
+	// Whether set replaces the data store rather than updating it. A
+	// restored VM starts with an empty one, unless the launcher set its own.
+	replace bool
+}
+
+func newGuestRequest(machine *firecracker.Machine, key string, console *consoleWatcher) *guestRequest {
+	r := &guestRequest{
+		machine: machine,
+		key:     key,
+		// New for every request, the agent acts when it changes
+		id: fmt.Sprint(time.Now().UnixNano()),
+	}
+	if console != nil {
+		r.done = console.watch(key + " done " + r.id)
+	}
+	return r
+}
+
+// Publish the request with the given fields.
+func (r *guestRequest) set(ctx context.Context, fields map[string]interface{}) error {
+	fields["id"] = r.id
+	request := map[string]interface{}{r.key: fields}
+	if r.replace {
+		return r.machine.SetMetadata(ctx, request)
+	}
+	return r.machine.UpdateMetadata(ctx, request)
+}
+
+// Wait for the agent to be done. Without the console the agent can't be
+// heard, so it gets the whole timeout and true is returned.
+func (r *guestRequest) wait(timeout time.Duration) bool {
+	if r.done == nil {
+		log.Warnf("Guest console not available, giving the guest %v for %s", timeout, r.key)
+		time.Sleep(timeout)
+		return true
+	}
+	select {
+	case <-r.done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// Snapshot the VM behind socketPath after the guest agent trimmed its
+// filesystems and ran quiesceCmd, as configured. A quiesce that times out
+// fails the snapshot, a trim that times out is only reported.
+func quiesceAndSnapshot(socketPath string, snapshotPath string, console *consoleWatcher) {
+	if captureDmesg {
+		if err := dmesgBeforeSnapshot(socketPath, snapshotPath, console); err != nil {
+			log.Warnf("Failed to capture the guest dmesg before the snapshot: %v", err)
+		}
+	}
+
+	if quiesceCmd == "" && !trimBeforeSnapshot {
+		createSnapshot(socketPath, snapshotPath)
+		return
+	}
+
+	ctx := context.Background()
+	cfg := firecracker.Config{SocketPath: socketPath}
+	machine, err := firecracker.NewMachine(ctx, cfg, firecracker.WithClient(newAPIClient(cfg.SocketPath)),
+		firecracker.WithLogger(log.NewEntry(log.New())))
+	if err != nil {
+		panic(fmt.Errorf("failed to create new machine: %v", err))
+	}
+
+	if trimBeforeSnapshot {
+		trim := newGuestRequest(machine, trimKey, console)
+		start := time.Now()
+		if err := trim.set(ctx, map[string]interface{}{}); err != nil {
+			panic(fmt.Errorf("failed to ask the guest to trim: %v", err))
+		}
+		if trim.wait(trimTimeout) {
+			fmt.Println("Trim duration:", time.Since(start))
+		} else {
+			log.Warnf("Guest trim not done after %v, snapshotting anyway", trimTimeout)
+		}
+	}
+
+	if quiesceCmd == "" {
+		createSnapshot(socketPath, snapshotPath)
+		return
+	}
+
+	quiesce := newGuestRequest(machine, quiesceKey, console)
+	state := func(s string) map[string]interface{} {
+		return map[string]interface{}{"cmd": quiesceCmd, "state": s}
+	}
+	start := time.Now()
+	if err := quiesce.set(ctx, state("quiesce")); err != nil {
+		panic(fmt.Errorf("failed to ask the guest to quiesce: %v", err))
+	}
+	if !quiesce.wait(quiesceTimeout) {
+		quiesce.set(ctx, state("resumed"))
+		panic(fmt.Errorf("guest not quiesced after %v, no snapshot taken", quiesceTimeout))
+	}
+	fmt.Println("Quiesce duration:", time.Since(start))
+
+	createSnapshot(socketPath, snapshotPath)
+
+	// Let the agent undo whatever quiescing involved
+	if err := quiesce.set(ctx, state("resumed")); err != nil {
+		log.Warnf("Failed to tell the guest it was resumed: %v", err)
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// statfs(2) f_type of the filesystems that keep their files in RAM
+const (
+	tmpfsMagic = 0x01021994
+	ramfsMagic = 0x858458f6
+)
+
+// Copy a memory file to the tmpfs mounted at dir, so that restoring never
+// waits for the disk. Returns the path of the copy.
+func copyToRamdisk(memPath string, dir string) (string, error) {
+	var fs syscall.Statfs_t
+	if err := syscall.Statfs(dir, &fs); err != nil {
+		return "", err
+	}
+	if fs.Type != tmpfsMagic && fs.Type != ramfsMagic {
+		return "", fmt.Errorf("%s is not a tmpfs or ramfs", dir)
+	}
+
+	info, err := os.Stat(memPath)
+	if err != nil {
+		return "", err
+	}
+	size := info.Size()
+	if free := int64(fs.Bavail) * fs.Bsize; fs.Type == tmpfsMagic && free < size {
+		return "", fmt.Errorf("%s has %d MiB free, %s needs %d MiB", dir, free>>20, memPath, size>>20)
+	}
+	// The copy takes host RAM on top of what the guest will use
+	available, err := hostAvailableMemoryMib()
+	if err != nil {
+		return "", fmt.Errorf("failed to read host memory: %v", err)
+	}
+	if available<<20 < size {
+		return "", fmt.Errorf("the host has %d MiB available, %s needs %d MiB", available, memPath, size>>20)
+	}
+
+	dst := filepath.Join(dir, fmt.Sprintf("launcher-%d-%s", os.Getpid(), filepath.Base(memPath)))
+	registerPath("ramdisk copy", dst)
+	if err := copyFile(memPath, dst); err != nil {
+		os.Remove(dst)
+		return "", err
+	}
+	return dst, nil
+}
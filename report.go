@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Version of the -report-file layout. Bumped when a field changes meaning
+// or goes away, new fields and map keys don't bump it.
+const runReportVersion = 1
+
+// The -report-file summary of a launcher run, nil without -report-file.
+// The recording methods of a nil runReport do nothing.
+var summary *runReport
+
+// Summary of a launcher run, in a layout dashboards can ingest as is.
+// Measurements go in maps keyed by name, so that every operation fits the
+// same layout.
+type runReport struct {
+	mu sync.Mutex
+
+	Version   int       `json:"version"`
+	Operation string    `json:"operation"`
+	Args      []string  `json:"args"`
+	StartedAt time.Time `json:"started_at"`
+	// Of the whole run
+	DurationMs float64 `json:"duration_ms"`
+	// "ok", or "failed" when the launcher exits with another code than 0,
+	// with what was measured until then
+	Status   string `json:"status"`
+	ExitCode int    `json:"exit_code"`
+	Error    string `json:"error,omitempty"`
+
+	Host struct {
+		Hostname string `json:"hostname"`
+		Arch     string `json:"arch"`
+		CPUs     int    `json:"cpus"`
+		MemMib   int64  `json:"mem_available_mib"`
+		*hostInfo
+	} `json:"host"`
+
+	// Single measurements, in milliseconds
+	Timings map[string]float64 `json:"timings_ms"`
+	// Distributions of repeated measurements
+	Latencies map[string]latencyStats `json:"latencies"`
+	// File and memory sizes, in bytes
+	Sizes map[string]int64 `json:"sizes_bytes"`
+	// Counts and ratios
+	Values map[string]float64 `json:"values"`
+}
+
+// Start a report, firecrackerBin is asked for its version.
+func newRunReport(firecrackerBin string) *runReport {
+	r := &runReport{
+		Version:   runReportVersion,
+		Args:      os.Args[1:],
+		StartedAt: time.Now().UTC(),
+		Timings:   map[string]float64{},
+		Latencies: map[string]latencyStats{},
+		Sizes:     map[string]int64{},
+		Values:    map[string]float64{},
+	}
+	r.Host.Hostname, _ = os.Hostname()
+	r.Host.Arch = hostArch()
+	r.Host.CPUs = runtime.NumCPU()
+	r.Host.MemMib, _ = hostAvailableMemoryMib()
+	// No VMM runs yet to ask, unlike readHostInfo
+	r.Host.hostInfo = &hostInfo{}
+	if out, err := runTool(firecrackerBin, "--version"); err == nil {
+		r.Host.FirecrackerVersion = strings.SplitN(out, "\n", 2)[0]
+	}
+	if release, err := ioutil.ReadFile("/proc/sys/kernel/osrelease"); err == nil {
+		r.Host.KernelVersion = strings.TrimSpace(string(release))
+	}
+	return r
+}
+
+// Record the operation the launcher runs, empty if it fails before picking
+// one.
+func (r *runReport) operation(name string) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Operation = name
+}
+
+func (r *runReport) timing(name string, d time.Duration) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Timings[name] = float64(d) / float64(time.Millisecond)
+}
+
+func (r *runReport) latencies(name string, d []time.Duration) {
+	if r == nil || len(d) == 0 {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Latencies[name] = newLatencyStats(d)
+}
+
+func (r *runReport) size(name string, bytes int64) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Sizes[name] = bytes
+}
+
+func (r *runReport) value(name string, v float64) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Values[name] = v
+}
+
+// Write the report to path, marking the run failed unless exitCode is 0.
+// failure is what the run panicked with, if it did.
+func (r *runReport) write(path string, exitCode int, failure interface{}) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.DurationMs = float64(time.Since(r.StartedAt)) / float64(time.Millisecond)
+	r.ExitCode = exitCode
+	r.Status = "ok"
+	if failure != nil {
+		r.Error = fmt.Sprint(failure)
+	}
+	if exitCode != exitOK || failure != nil {
+		r.Status = "failed"
+	}
+
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, append(data, '\n'), 0644)
+}
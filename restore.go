@@ -0,0 +1,462 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	firecracker "github.com/firecracker-microvm/firecracker-go-sdk"
+	ops "github.com/firecracker-microvm/firecracker-go-sdk/client/operations"
+)
+
+// Durations of the phases of a restore
+type restorePhases struct {
+	processStart time.Duration
+	socketWait   time.Duration
+	loadSnapshot time.Duration
+	resume       time.Duration
+	// Zero if the guest readiness wasn't probed
+	guestReady time.Duration
+	// Zero without -mem-ramdisk
+	ramdiskCopy time.Duration
+	// Zero without -warmup-io
+	warmupIO time.Duration
+}
+
+// Record the phases in the -report-file summary.
+func (p restorePhases) record() {
+	summary.timing("process_start", p.processStart)
+	summary.timing("socket_wait", p.socketWait)
+	summary.timing("load_snapshot", p.loadSnapshot)
+	summary.timing("resume", p.resume)
+	if p.guestReady != 0 {
+		summary.timing("guest_ready", p.guestReady)
+	}
+	if p.ramdiskCopy != 0 {
+		summary.timing("ramdisk_copy", p.ramdiskCopy)
+	}
+	if p.warmupIO != 0 {
+		summary.timing("warmup_io", p.warmupIO)
+	}
+}
+
+// Emit the phases as a single structured log entry.
+func (p restorePhases) log(snapshotPath string) {
+	p.record()
+
+	ms := func(d time.Duration) float64 {
+		return float64(d) / float64(time.Millisecond)
+	}
+
+	fields := log.Fields{
+		"snapshot":         snapshotPath,
+		"process_start_ms": ms(p.processStart),
+		"socket_wait_ms":   ms(p.socketWait),
+		"load_snapshot_ms": ms(p.loadSnapshot),
+		"resume_ms":        ms(p.resume),
+	}
+	if p.guestReady != 0 {
+		fields["guest_ready_ms"] = ms(p.guestReady)
+	}
+	if p.ramdiskCopy != 0 {
+		fields["ramdisk_copy_ms"] = ms(p.ramdiskCopy)
+	}
+	if p.warmupIO != 0 {
+		fields["warmup_io_ms"] = ms(p.warmupIO)
+	}
+	log.WithFields(fields).Info("Restore phases")
+}
+
+// A microVM restored from a snapshot by restoreVM
+type restoredVM struct {
+	machine *firecracker.Machine
+	// Guest console, nil unless something needs to watch it
+	console *consoleWatcher
+	// Snapshot the VM was restored from
+	snapshotPath string
+	// Of the VMM process
+	pid int
+	// Closed once the VMM process exited and was reaped, exitErr then holds
+	// what cmd.Wait returned. The SDK's Machine.Wait never returns for a
+	// process it didn't start.
+	exited  <-chan struct{}
+	exitErr error
+	phases  restorePhases
+	// Stops the VMM and undoes the host setup
+	stop func()
+}
+
+// Wait for the VMM to exit and return how it ended.
+func (vm *restoredVM) wait() error {
+	<-vm.exited
+	return vm.exitErr
+}
+
+// Poll the API socket of a starting VMM every interval, up to count times,
+// until it answers. Returns how long that took.
+func waitForAPI(socketPath string, interval time.Duration, count int) (time.Duration, error) {
+	client := newAPIClient(socketPath)
+	start := time.Now()
+	for i := 0; i < count; i++ {
+		if _, err := os.Stat(socketPath); err == nil {
+			if _, err := client.GetMachineConfiguration(); err == nil {
+				return time.Since(start), nil
+			}
+		}
+		time.Sleep(interval)
+	}
+	return time.Since(start), fmt.Errorf("no API on %s after %d polls in %v", socketPath, count, time.Since(start))
+}
+
+// Start a new Firecracker process and load a snapshot into it.
+// The VM is left paused.
+func restoreVM(socketPath string, snapshotPath string, opts vmOptions) *restoredVM {
+	if err := requireFiles(opts.firecracker, snapshotPath+".mem", snapshotPath+".file"); err != nil {
+		panic(err)
+	}
+	if err := checkRestoreMemory(snapshotPath, opts.allowOvercommit); err != nil {
+		panic(err)
+	}
+	if err := checkMMDS(opts); err != nil {
+		panic(err)
+	}
+	if opts.rootfsOverride != "" {
+		if err := requireFiles(opts.rootfsOverride); err != nil {
+			panic(err)
+		}
+	}
+
+	// Remove the socket path if it exists, unless another launcher uses it
+	unlock := manageVM(socketPath, opts.force)
+	// Released once the VMM exits, unless it doesn't start
+	started := false
+	defer func() {
+		if !started {
+			unlock()
+		}
+	}()
+	if _, err := os.Stat(socketPath); err == nil {
+		os.Remove(socketPath)
+	}
+	registerPath("socket", socketPath)
+
+	cfg := firecracker.Config{
+		SocketPath:        socketPath,
+		DisableValidation: true,
+	}
+
+	// Create a context, cancelling it kills Firecracker, and so do signals
+	ctx, cancel := context.WithCancel(vmmContext)
+
+	// Build the command. A jailed VMM sees the snapshot inside its chroot.
+	var cmd *exec.Cmd
+	apiSnapshot := snapshotPath
+	if opts.jail != nil {
+		cmd = opts.jail.command(ctx, opts)
+		apiSnapshot = opts.jail.inside(opts.firecracker, snapshotPath)
+	} else {
+		cmd = firecracker.VMCommandBuilder{}.
+			WithSocketPath(socketPath).
+			WithBin(opts.firecracker).
+			WithArgs(vmmArgs(opts)).
+			WithStdin(os.Stdin).
+			WithStdout(os.Stdout).
+			WithStderr(os.Stderr).
+			Build(ctx)
+	}
+	cmd.Dir = opts.workDir
+	console, hostCleanup := setupHost(cmd, opts)
+
+	logger := log.New()
+	vm := &restoredVM{console: console, snapshotPath: snapshotPath}
+
+	// Start Firecracker
+	start := time.Now()
+	exited := make(chan struct{})
+	vm.exited = exited
+	err := cmd.Start()
+	if err != nil {
+		logger.Error("Failed to start Firecracker")
+		close(exited)
+	} else {
+		started = true
+		unregister := registerProcess(cmd.Process.Pid)
+		vm.pid = cmd.Process.Pid
+		go func() {
+			vm.exitErr = cmd.Wait()
+			unregister()
+			unlock()
+			close(exited)
+		}()
+	}
+	vm.phases.processStart = time.Since(start)
+
+	cgroupCleanup := func() {}
+	vm.stop = func() {
+		cancel()
+		<-exited
+		recordEvent("stop", socketPath, "")
+		cgroupCleanup()
+		hostCleanup()
+		os.Remove(socketPath)
+	}
+
+	// Before the snapshot is loaded, so that the guest memory is charged
+	// to the cgroup
+	if err == nil && !opts.cgroup.empty() {
+		cgroupCleanup, err = joinCgroup(cgroupName(socketPath), cmd.Process.Pid, opts.cgroup)
+		if err != nil {
+			vm.stop()
+			panic(fmt.Errorf("failed to set up cgroup: %v", err))
+		}
+	}
+
+	vm.machine, err = firecracker.NewMachine(ctx, cfg, firecracker.WithClient(newAPIClient(cfg.SocketPath)),
+		firecracker.WithLogger(log.NewEntry(logger)))
+	if err != nil {
+		vm.stop()
+		panic(fmt.Errorf("failed to create new machine: %v", err))
+	}
+
+	vm.phases.socketWait, err = waitForAPI(socketPath, opts.socketPollInterval, opts.socketPollCount)
+	if err == nil {
+		err = applySocketMode(socketPath, opts.socketMode)
+	}
+	if err != nil {
+		vm.stop()
+		panic(err)
+	}
+
+	memPath := apiSnapshot + ".mem"
+	if opts.memRamdisk != "" {
+		start = time.Now()
+		if memPath, err = copyToRamdisk(memPath, opts.memRamdisk); err != nil {
+			vm.stop()
+			panic(fmt.Errorf("failed to copy memory to ramdisk: %v", err))
+		}
+		vm.phases.ramdiskCopy = time.Since(start)
+		fmt.Println("Copy to ramdisk duration:", vm.phases.ramdiskCopy)
+
+		stop := vm.stop
+		vm.stop = func() {
+			stop()
+			os.Remove(memPath)
+		}
+	}
+
+	start = time.Now()
+	err = vm.machine.LoadSnapshot(ctx, memPath, apiSnapshot+".file",
+		func(params *ops.LoadSnapshotParams) {
+			// Needed to take diff snapshots of the restored VM
+			params.Body.EnableDiffSnapshots = opts.diffSnapshots
+		})
+	if err != nil {
+		vm.stop()
+		panic(fmt.Errorf("failed to load snapshot: %v", err))
+	}
+	recordEvent("restore", socketPath, snapshotPath)
+	vm.phases.loadSnapshot = time.Since(start)
+	fmt.Println("Load snapshot duration:", vm.phases.loadSnapshot)
+
+	if opts.rootfsOverride != "" {
+		log.Warnf("UNSUPPORTED: replacing the root drive of the restored guest with %s. "+
+			"The guest's page cache and filesystem state still describe the old disk, "+
+			"this can corrupt the guest and the new file.", opts.rootfsOverride)
+		if err := vm.machine.UpdateGuestDrive(ctx, rootDriveID, opts.rootfsOverride); err != nil {
+			vm.stop()
+			panic(fmt.Errorf("failed to replace the root drive: %v", err))
+		}
+	}
+
+	// Before the resume, so the guest never sees the golden snapshot's data
+	if opts.metadata != nil {
+		if err := vm.machine.SetMetadata(ctx, opts.metadata); err != nil {
+			vm.stop()
+			panic(fmt.Errorf("failed to replace the MMDS data: %v", err))
+		}
+		log.Infof("Replaced the MMDS data of the restored VM, %d top-level keys", len(opts.metadata))
+	}
+
+	return vm
+}
+
+// Policies accepted by -on-resume-fail
+var resumeFailPolicies = []string{"retry", "fail", "leave-paused"}
+
+// How many times the retry policy retries a failed resume
+const resumeRetries = 3
+
+// Returned by resumeRestored when the VM was left paused on purpose
+var errLeftPaused = errors.New("VM left paused after a failed resume")
+
+func validateResumeFailPolicy(policy string) error {
+	for _, p := range resumeFailPolicies {
+		if p == policy {
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown -on-resume-fail policy %q, expected one of %s",
+		policy, strings.Join(resumeFailPolicies, ", "))
+}
+
+// Resume a restored VM, handling a failure as opts.onResumeFail says.
+// Returns errLeftPaused if the VM was left paused.
+func resumeWithPolicy(ctx context.Context, vm *restoredVM, opts vmOptions) error {
+	err := vm.machine.ResumeVM(ctx)
+	for attempt := 0; err != nil && opts.onResumeFail == "retry" && attempt < resumeRetries; attempt++ {
+		log.Warnf("Resume attempt %d failed, retrying: %v", attempt+1, err)
+		time.Sleep(100 * time.Millisecond)
+		err = vm.machine.ResumeVM(ctx)
+	}
+	if err == nil {
+		return nil
+	}
+	if opts.onResumeFail == "leave-paused" {
+		log.Errorf("Failed to resume VM, leaving it paused on %s for inspection: %v",
+			vm.machine.Cfg.SocketPath, err)
+		return errLeftPaused
+	}
+	return fmt.Errorf("failed to resume VM: %v", err)
+}
+
+// Resume a restored VM and, if configured, wait for the guest to report
+// that it's ready and to warm up its caches.
+func resumeRestored(vm *restoredVM, opts vmOptions) error {
+	ctx := context.Background()
+
+	var ready <-chan struct{}
+	if opts.readyPattern != "" {
+		ready = vm.console.watch(opts.readyPattern)
+	}
+
+	start := time.Now()
+	if err := resumeWithPolicy(ctx, vm, opts); err != nil {
+		return err
+	}
+	vm.phases.resume = time.Since(start)
+	recordEvent("resume", vm.machine.Cfg.SocketPath, "")
+
+	if ready != nil {
+		select {
+		case <-ready:
+			vm.phases.guestReady = time.Since(start) - vm.phases.resume
+		case <-time.After(opts.readyTimeout):
+			log.Warnf("Guest not ready %v after resume", opts.readyTimeout)
+		}
+	}
+
+	if len(opts.warmupIO) != 0 {
+		var err error
+		vm.phases.warmupIO, err = warmupGuestIO(vm, opts.warmupIO, opts.readyTimeout, opts.metadata != nil)
+		if err != nil {
+			log.Warn(err)
+		}
+		fmt.Println("Warm-up I/O duration:", vm.phases.warmupIO)
+	}
+
+	if captureDmesg {
+		if err := dmesgAfterRestore(vm, opts); err != nil {
+			log.Warnf("Failed to capture the guest dmesg after the restore: %v", err)
+		}
+	}
+	return nil
+}
+
+// Load a snapshot from a given path.
+// Handles VM socket path and a snapshot path.
+// Returns the launcher exit code.
+func loadSnapshot(socketPath string, snapshotPath string, opts vmOptions) int {
+	vm := restoreVM(socketPath, snapshotPath, opts)
+	defer vm.stop()
+
+	switch err := resumeRestored(vm, opts); err {
+	case nil:
+		vm.phases.log(snapshotPath)
+	case errLeftPaused:
+		// Keep the VMM around until it's stopped from outside
+		vm.wait()
+		return exitFailure
+	default:
+		log.Error(err)
+		return exitFailure
+	}
+
+	if opts.maxRestoreLatency != 0 {
+		// A guest that never got ready missed the target whatever the load took
+		if opts.readyPattern != "" && vm.phases.guestReady == 0 {
+			log.Errorf("Guest not ready %v after resume, target is %v: tearing down the VM", opts.readyTimeout, opts.maxRestoreLatency)
+			return exitFailure
+		}
+		latency := vm.phases.loadSnapshot + vm.phases.guestReady
+		if latency > opts.maxRestoreLatency {
+			log.Errorf("Restore took %v, target is %v: tearing down the VM", latency, opts.maxRestoreLatency)
+			return exitRestoreTooSlow
+		}
+		log.Infof("Restore took %v, target is %v", latency, opts.maxRestoreLatency)
+	}
+
+	// wait for the VMM to exit
+	err := vm.wait()
+	// A hot upgrade stops the VMM on purpose
+	handed := handedOver(socketPath, vm.pid)
+	if err != nil && !stopping() && !handed {
+		panic(fmt.Errorf("Wait returned an error %s", err))
+	}
+	return exitOK
+}
+
+// Restore a snapshot, let the guest run for settle, then pause it and take
+// a diff snapshot. Used to move a diff snapshot chain forward.
+func restoreAndSnapshot(socketPath string, fromPath string, toPath string, settle time.Duration, opts vmOptions) {
+	if settle < 0 {
+		panic(fmt.Errorf("settle duration must not be negative, got %v", settle))
+	}
+
+	opts.diffSnapshots = true
+	vm := restoreVM(socketPath, fromPath, opts)
+	defer vm.stop()
+
+	ctx := context.Background()
+	if err := resumeRestored(vm, opts); err != nil {
+		panic(err)
+	}
+	fmt.Println("Resume duration:", vm.phases.resume)
+	vm.phases.record()
+
+	time.Sleep(settle)
+	fmt.Println("Settle duration:", settle)
+
+	start := time.Now()
+	if err := vm.machine.PauseVM(ctx); err != nil {
+		panic(fmt.Errorf("failed to pause VM: %v", err))
+	}
+	recordEvent("pause", socketPath, "")
+	fmt.Println("Pause duration:", time.Since(start))
+	summary.timing("pause", time.Since(start))
+
+	start = time.Now()
+	err := vm.machine.CreateSnapshot(ctx, toPath+".mem", toPath+".file",
+		func(data *ops.CreateSnapshotParams) {
+			data.Body.SnapshotType = "Diff"
+		})
+	if err != nil {
+		panic(fmt.Errorf("failed to create snapshot: %v", err))
+	}
+	fmt.Println("Created snapshot duration:", time.Since(start))
+	summary.timing("create_snapshot", time.Since(start))
+	recordEvent("snapshot", socketPath, toPath)
+
+	manifest, err := newManifest(socketPath, toPath, "Diff")
+	if err == nil {
+		err = writeManifest(toPath, manifest)
+	}
+	if err != nil {
+		panic(fmt.Errorf("failed to write manifest: %v", err))
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+
+	firecracker "github.com/firecracker-microvm/firecracker-go-sdk"
+	ops "github.com/firecracker-microvm/firecracker-go-sdk/client/operations"
+)
+
+// Granularity at which memory files are compared
+const pageSize = 4096
+
+// A [start, end) byte range of a memory file
+type memRegion struct {
+	start int64
+	end   int64
+}
+
+func (r memRegion) String() string {
+	return fmt.Sprintf("0x%x-0x%x (%d pages)", r.start, r.end, (r.end-r.start)/pageSize)
+}
+
+func (r memRegion) contains(off int64) bool {
+	return off >= r.start && off < r.end
+}
+
+// Parse a comma separated list of start-end ranges, e.g. "0x1000-0x3000".
+func parseRegions(list string) ([]memRegion, error) {
+	var regions []memRegion
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		bounds := strings.SplitN(item, "-", 2)
+		if len(bounds) != 2 {
+			return nil, fmt.Errorf("invalid region %q, expected start-end", item)
+		}
+		start, err := strconv.ParseInt(bounds[0], 0, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid region start %q", bounds[0])
+		}
+		end, err := strconv.ParseInt(bounds[1], 0, 64)
+		if err != nil || end < start {
+			return nil, fmt.Errorf("invalid region end %q", bounds[1])
+		}
+		regions = append(regions, memRegion{start, end})
+	}
+	return regions, nil
+}
+
+// Compare two memory files page by page and return the regions that differ,
+// leaving out pages that fall inside one of the tolerated regions.
+func diffMemFiles(pathA string, pathB string, tolerated []memRegion) ([]memRegion, error) {
+	a, unmapA, err := mapFile(pathA)
+	if err != nil {
+		return nil, err
+	}
+	defer unmapA()
+
+	b, unmapB, err := mapFile(pathB)
+	if err != nil {
+		return nil, err
+	}
+	defer unmapB()
+
+	if len(a) != len(b) {
+		return nil, fmt.Errorf("memory files differ in size: %d and %d bytes", len(a), len(b))
+	}
+
+	isTolerated := func(off int64) bool {
+		for _, r := range tolerated {
+			if r.contains(off) {
+				return true
+			}
+		}
+		return false
+	}
+
+	var diffs []memRegion
+	for off := 0; off < len(a); off += pageSize {
+		end := off + pageSize
+		if end > len(a) {
+			end = len(a)
+		}
+		if bytes.Equal(a[off:end], b[off:end]) || isTolerated(int64(off)) {
+			continue
+		}
+
+		// Merge with the previous region if adjacent
+		if n := len(diffs); n > 0 && diffs[n-1].end == int64(off) {
+			diffs[n-1].end = int64(end)
+		} else {
+			diffs = append(diffs, memRegion{int64(off), int64(end)})
+		}
+	}
+	return diffs, nil
+}
+
+func fullSnapshot(ctx context.Context, machine *firecracker.Machine, snapshotPath string) error {
+	err := machine.CreateSnapshot(ctx, snapshotPath+".mem", snapshotPath+".file",
+		func(data *ops.CreateSnapshotParams) {
+			data.Body.SnapshotType = "Full"
+		})
+	if err == nil {
+		recordEvent("snapshot", machine.Cfg.SocketPath, snapshotPath)
+	}
+	return err
+}
+
+// Snapshot the VM behind socketPath, restore that snapshot into a second
+// VMM, snapshot the restored VM and compare the memory of both snapshots.
+// The original VM stays paused until the cycle is done, the restored one is
+// never resumed, so both snapshots should hold the same guest state.
+func roundtrip(socketPath string, prefix string, tolerated []memRegion, opts vmOptions) ([]memRegion, error) {
+	ctx := context.Background()
+	cfg := firecracker.Config{SocketPath: socketPath}
+
+	logger := log.New()
+	machine, err := firecracker.NewMachine(ctx, cfg, firecracker.WithClient(newAPIClient(cfg.SocketPath)),
+		firecracker.WithLogger(log.NewEntry(logger)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create new machine: %v", err)
+	}
+
+	if err := machine.PauseVM(ctx); err != nil {
+		return nil, fmt.Errorf("failed to pause VM: %v", err)
+	}
+	recordEvent("pause", socketPath, "")
+	defer func() {
+		machine.ResumeVM(ctx)
+		recordEvent("resume", socketPath, "")
+	}()
+
+	first := prefix + "-1"
+	registerSnapshot(first)
+	if err := fullSnapshot(ctx, machine, first); err != nil {
+		return nil, fmt.Errorf("failed to snapshot original VM: %v", err)
+	}
+	fmt.Println("Created snapshot", first)
+
+	restored := restoreVM(socketPath+".roundtrip", first, opts)
+	defer restored.stop()
+
+	second := prefix + "-2"
+	registerSnapshot(second)
+	if err := fullSnapshot(ctx, restored.machine, second); err != nil {
+		return nil, fmt.Errorf("failed to snapshot restored VM: %v", err)
+	}
+	fmt.Println("Created snapshot", second)
+
+	return diffMemFiles(first+".mem", second+".mem", tolerated)
+}
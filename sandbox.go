@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+
+	firecracker "github.com/firecracker-microvm/firecracker-go-sdk"
+)
+
+// API socket of a jailed VMM, inside its chroot
+const jailSocket = "/api.sock"
+
+// Where a restored VMM runs under the jailer
+type jailConfig struct {
+	jailer   string
+	id       string
+	uid, gid int
+	// The jailer builds the chroot in <baseDir>/<exec file>/<id>/root
+	baseDir string
+}
+
+func (j *jailConfig) root(execFile string) string {
+	return filepath.Join(j.baseDir, filepath.Base(execFile), j.id, "root")
+}
+
+// The path the jailed VMM sees for a host path inside its chroot.
+func (j *jailConfig) inside(execFile string, path string) string {
+	rel, err := filepath.Rel(j.root(execFile), path)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		panic(fmt.Errorf("%s is outside the chroot of %s", path, j.id))
+	}
+	return "/" + rel
+}
+
+func (j *jailConfig) command(ctx context.Context, opts vmOptions) *exec.Cmd {
+	return firecracker.NewJailerCommandBuilder().
+		WithBin(j.jailer).
+		WithID(j.id).
+		WithUID(j.uid).
+		WithGID(j.gid).
+		WithExecFile(opts.firecracker).
+		WithChrootBaseDir(j.baseDir).
+		WithFirecrackerArgs(append([]string{"--api-sock", jailSocket}, vmmArgs(opts)...)...).
+		WithStdin(os.Stdin).
+		WithStdout(os.Stdout).
+		WithStderr(os.Stderr).
+		Build(ctx)
+}
+
+// Remove the cgroups the jailer made for the VMM, both v1 and v2 layouts.
+func (j *jailConfig) removeCgroups() {
+	dirs, _ := filepath.Glob(filepath.Join(cgroupRoot, "*/firecracker", j.id))
+	dirs = append(dirs, filepath.Join(cgroupRoot, "firecracker", j.id))
+	for _, dir := range dirs {
+		if err := os.Remove(dir); err != nil && !os.IsNotExist(err) {
+			log.Warnf("Failed to remove jailer cgroup %s: %v", dir, err)
+		}
+	}
+}
+
+// Copy src to dst in a chroot, owned by the uid and gid the VMM runs as.
+func copyIntoChroot(src string, dst string, uid int, gid int) error {
+	dir := filepath.Dir(dst)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	if err := copyFile(src, dst); err != nil {
+		return err
+	}
+	return os.Chown(dst, uid, gid)
+}
+
+// Restore snapshotPath in a throwaway jailer chroot holding copies of the
+// snapshot and of the root drive, resume it and check the VMM survives,
+// then tear everything down, whatever happened. Nothing the snapshot makes
+// the VMM do reaches the host files. Prints whether it passed and returns
+// the exit code.
+func sandboxValidate(snapshotPath string, jail *jailConfig, opts vmOptions) int {
+	// They'd hand host paths and resources to the jailed VMM
+	if opts.memRamdisk != "" || opts.rootfsOverride != "" || opts.netNS != "" || !opts.cgroup.empty() {
+		panic(fmt.Errorf("-sandbox-validate can't be combined with -mem-ramdisk, -rootfs, -netns or cgroup limits"))
+	}
+	if opts.debugVMM {
+		panic(fmt.Errorf("-sandbox-validate runs untrusted snapshots, not with -debug-vmm"))
+	}
+
+	base, err := ioutil.TempDir("", "sandbox-validate")
+	if err != nil {
+		panic(err)
+	}
+	jail.baseDir = base
+	registerPath("sandbox chroot", base)
+	defer func() {
+		jail.removeCgroups()
+		if err := os.RemoveAll(base); err != nil {
+			log.Errorf("Failed to remove the sandbox chroot %s: %v", base, err)
+		}
+	}()
+
+	err = func() (err error) {
+		// restoreVM panics on failure, after cleaning up
+		defer func() {
+			if p := recover(); p != nil {
+				err = fmt.Errorf("%v", p)
+			}
+		}()
+		if err := checkSnapshotArch(snapshotPath); err != nil {
+			return err
+		}
+
+		root := jail.root(opts.firecracker)
+		jailed := filepath.Join(root, "snapshot")
+		copies := map[string]string{
+			snapshotPath + ".mem":  jailed + ".mem",
+			snapshotPath + ".file": jailed + ".file",
+			// The snapshot opens its drives at the paths it was taken with
+			opts.rootfs: filepath.Join(root, opts.rootfs),
+		}
+		if _, err := os.Stat(manifestPath(snapshotPath)); err == nil {
+			copies[manifestPath(snapshotPath)] = manifestPath(jailed)
+		}
+		for src, dst := range copies {
+			if err := copyIntoChroot(src, dst, jail.uid, jail.gid); err != nil {
+				return fmt.Errorf("failed to copy %s into the chroot: %v", src, err)
+			}
+		}
+
+		opts.jail = jail
+		opts.detached = true
+		vm := restoreVM(filepath.Join(root, jailSocket), jailed, opts)
+		defer vm.stop()
+		if err := resumeRestored(vm, opts); err != nil {
+			return err
+		}
+		if opts.readyPattern != "" && vm.phases.guestReady == 0 {
+			return fmt.Errorf("guest not ready %v after resume", opts.readyTimeout)
+		}
+		if processGone(vm.pid) {
+			return fmt.Errorf("VMM exited after the resume")
+		}
+		return nil
+	}()
+
+	if err != nil {
+		fmt.Printf("%s: FAIL: %v\n", snapshotPath, err)
+		return exitFailure
+	}
+	fmt.Printf("%s: PASS\n", snapshotPath)
+	return exitOK
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	firecracker "github.com/firecracker-microvm/firecracker-go-sdk"
+)
+
+// A VM started by a script, stopped on "stop" or at the end of the script
+type scriptVM struct {
+	socketPath string
+	// MAC of the guest NIC, empty without one
+	mac  string
+	stop func()
+}
+
+// Runs the operations of a -script file against named VMs. VM "name" uses
+// the API socket "name.sock".
+type scriptRunner struct {
+	args string
+	opts vmOptions
+	vms  map[string]*scriptVM
+	// Launches so far, numbering the TAP device of each launched VM
+	launches int
+}
+
+// Operations of the script language and the number of arguments they take
+var scriptOps = map[string]int{
+	"launch":   1, // launch <vm>
+	"restore":  2, // restore <vm> <snapshot>
+	"snapshot": 2, // snapshot <vm> <snapshot>
+	"pause":    1, // pause <vm>
+	"resume":   1, // resume <vm>
+	"stop":     1, // stop <vm>
+	"sleep":    1, // sleep <duration>
+}
+
+func (r *scriptRunner) machine(name string) (*firecracker.Machine, error) {
+	vm, ok := r.vms[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown VM %q", name)
+	}
+	cfg := firecracker.Config{SocketPath: vm.socketPath}
+	return firecracker.NewMachine(context.Background(), cfg, firecracker.WithClient(newAPIClient(cfg.SocketPath)),
+		firecracker.WithLogger(log.NewEntry(log.New())))
+}
+
+func (r *scriptRunner) launch(name string) error {
+	if _, ok := r.vms[name]; ok {
+		return fmt.Errorf("VM %q already exists", name)
+	}
+	socketPath := name + ".sock"
+	if err := makeAbsolute(&socketPath); err != nil {
+		return err
+	}
+
+	opts := r.opts
+	mac := ""
+	if opts.netNS != "" {
+		// One TAP can only be opened by one VMM
+		opts.tapName = fmt.Sprintf("%s-%d", r.opts.tapName, r.launches)
+		if len(opts.tapName) > 15 {
+			return fmt.Errorf("TAP device name %s of VM %q is longer than 15 characters", opts.tapName, name)
+		}
+		r.launches++
+		if opts.mac == "" {
+			opts.mac = macFromName(name)
+		}
+		for other, vm := range r.vms {
+			if vm.mac == opts.mac {
+				return fmt.Errorf("VM %q would get the MAC %s of VM %q", name, opts.mac, other)
+			}
+		}
+		mac = opts.mac
+	}
+
+	done := make(chan struct{})
+	// What launchVM panicked with, it does on failure
+	failed := make(chan error, 1)
+	go func() {
+		defer close(done)
+		defer func() {
+			if err := recover(); err != nil {
+				log.Debugf("VM %s: %v", name, err)
+				failed <- fmt.Errorf("%v", err)
+			}
+		}()
+		launchVM(socketPath, r.args, opts)
+	}()
+
+	r.vms[name] = &scriptVM{
+		socketPath: socketPath,
+		mac:        mac,
+		stop: func() {
+			if pid, err := findVMMPid(socketPath); err == nil {
+				syscall.Kill(pid, syscall.SIGTERM)
+			}
+			<-done
+		},
+	}
+	// Fail the step as soon as the VM does, without polling for its API
+	// until it gives up
+	api := make(chan error, 1)
+	go func() {
+		_, err := waitForAPI(socketPath, r.opts.socketPollInterval, r.opts.socketPollCount)
+		api <- err
+	}()
+	select {
+	case err := <-api:
+		return err
+	case <-done:
+		select {
+		case err := <-failed:
+			return fmt.Errorf("VM %q failed to launch: %v", name, err)
+		default:
+			return fmt.Errorf("VM %q exited before its API came up", name)
+		}
+	}
+}
+
+func (r *scriptRunner) restore(name string, snapshotPath string) error {
+	if _, ok := r.vms[name]; ok {
+		return fmt.Errorf("VM %q already exists", name)
+	}
+	socketPath := name + ".sock"
+	if err := makeAbsolute(&socketPath, &snapshotPath); err != nil {
+		return err
+	}
+
+	vm := restoreVM(socketPath, snapshotPath, r.opts)
+	r.vms[name] = &scriptVM{socketPath: socketPath, stop: vm.stop}
+	if err := resumeRestored(vm, r.opts); err != nil {
+		return err
+	}
+	vm.phases.log(snapshotPath)
+	return nil
+}
+
+func (r *scriptRunner) step(op string, args []string) error {
+	switch op {
+	case "launch":
+		return r.launch(args[0])
+	case "restore":
+		return r.restore(args[0], args[1])
+	case "snapshot":
+		vm, ok := r.vms[args[0]]
+		if !ok {
+			return fmt.Errorf("unknown VM %q", args[0])
+		}
+		snapshotPath := args[1]
+		if err := makeAbsolute(&snapshotPath); err != nil {
+			return err
+		}
+		quiesceAndSnapshot(vm.socketPath, snapshotPath, nil)
+		return nil
+	case "pause", "resume":
+		machine, err := r.machine(args[0])
+		if err != nil {
+			return err
+		}
+		if op == "pause" {
+			err = machine.PauseVM(context.Background())
+		} else {
+			err = machine.ResumeVM(context.Background())
+		}
+		if err == nil {
+			recordEvent(op, machine.Cfg.SocketPath, "")
+		}
+		return err
+	case "stop":
+		vm, ok := r.vms[args[0]]
+		if !ok {
+			return fmt.Errorf("unknown VM %q", args[0])
+		}
+		vm.stop()
+		delete(r.vms, args[0])
+		return nil
+	case "sleep":
+		d, err := time.ParseDuration(args[0])
+		if err != nil {
+			return err
+		}
+		time.Sleep(d)
+		return nil
+	}
+	return fmt.Errorf("unknown operation %q", op)
+}
+
+// Run a step, turning the panics of the operations into errors.
+func (r *scriptRunner) run(op string, args []string) (err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf("%v", p)
+		}
+	}()
+	return r.step(op, args)
+}
+
+// Parse the whole script up front so that syntax errors are found before
+// anything runs.
+func parseScript(path string) ([][]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var steps [][]string
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		nargs, ok := scriptOps[fields[0]]
+		if !ok {
+			return nil, fmt.Errorf("%s:%d: unknown operation %q", path, n, fields[0])
+		}
+		if len(fields)-1 != nargs {
+			return nil, fmt.Errorf("%s:%d: %s takes %d argument(s)", path, n, fields[0], nargs)
+		}
+		steps = append(steps, fields)
+	}
+	return steps, scanner.Err()
+}
+
+// Execute a script, returning the number of failed steps. VMs still running
+// at the end are stopped.
+func runScript(path string, args string, opts vmOptions, continueOnError bool) int {
+	steps, err := parseScript(path)
+	if err != nil {
+		panic(err)
+	}
+
+	// Script VMs share the terminal, don't let them read from it
+	opts.detached = true
+	r := &scriptRunner{args: args, opts: opts, vms: map[string]*scriptVM{}}
+	defer func() {
+		for _, vm := range r.vms {
+			vm.stop()
+		}
+	}()
+
+	failed := 0
+	for i, fields := range steps {
+		start := time.Now()
+		err := r.run(fields[0], fields[1:])
+		line := strings.Join(fields, " ")
+		if err != nil {
+			failed++
+			fmt.Printf("step %d: %s: FAILED after %v: %v\n", i+1, line, time.Since(start), err)
+			if !continueOnError {
+				break
+			}
+			continue
+		}
+		fmt.Printf("step %d: %s: ok (%v)\n", i+1, line, time.Since(start))
+	}
+	return failed
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	firecracker "github.com/firecracker-microvm/firecracker-go-sdk"
+)
+
+// How long createSnapshot gives the guest agent to scrub free memory, set
+// by -scrub-mem. Zero to not ask for it.
+var scrubMemWait time.Duration
+
+// MMDS key the guest agent polls for scrub requests
+const scrubMemKey = "scrub_mem"
+
+// Ask the guest agent through MMDS to zero free memory and drop caches,
+// then give it scrubMemWait to do so. The console isn't watched here, so a
+// slow agent is not noticed.
+func scrubGuestMemory(ctx context.Context, machine *firecracker.Machine) error {
+	request := newGuestRequest(machine, scrubMemKey, nil)
+	if err := request.set(ctx, map[string]interface{}{}); err != nil {
+		return fmt.Errorf("failed to ask the guest to scrub memory: %v", err)
+	}
+	request.wait(scrubMemWait)
+	return nil
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"syscall"
+)
+
+// Firecracker emulates a single 16550 UART, the guest's ttyS0
+const maxSerialPorts = 1
+
+func validateSerialPorts(n int) error {
+	if n < 0 || n > maxSerialPorts {
+		return fmt.Errorf("Firecracker supports up to %d serial port, got %d; use vsock for a second stream", maxSerialPorts, n)
+	}
+	return nil
+}
+
+// Open where the guest serial console goes: "stdout", "file:<path>" or
+// "fifo:<path>". Returns nil for stdout.
+func openSerialOutput(dest string) (*os.File, error) {
+	if dest == "" || dest == "stdout" {
+		return nil, nil
+	}
+	kv := strings.SplitN(dest, ":", 2)
+	if len(kv) != 2 || kv[1] == "" {
+		return nil, fmt.Errorf("invalid serial destination %q, expected stdout, file:<path> or fifo:<path>", dest)
+	}
+
+	if _, err := os.Stat(kv[1]); os.IsNotExist(err) {
+		registerPath("serial output", kv[1])
+	}
+	switch kv[0] {
+	case "file":
+		return os.OpenFile(kv[1], os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	case "fifo":
+		if err := syscall.Mkfifo(kv[1], 0644); err != nil && err != syscall.EEXIST {
+			return nil, fmt.Errorf("failed to create fifo %s: %v", kv[1], err)
+		}
+		// Read-write so that opening doesn't wait for a reader and the
+		// guest doesn't get EPIPE while nobody is reading
+		return os.OpenFile(kv[1], os.O_RDWR, 0)
+	}
+	return nil, fmt.Errorf("invalid serial destination %q, expected stdout, file:<path> or fifo:<path>", dest)
+}
+
+// Set up the kernel arguments for n serial ports. Without any the kernel
+// doesn't probe the UART and logs nowhere, which speeds up the boot.
+func withSerialPorts(args string, n int) string {
+	if n != 0 {
+		return args
+	}
+	var tokens []string
+	for _, tok := range splitKernelArgs(args) {
+		if !strings.HasPrefix(tok, "console=ttyS") {
+			tokens = append(tokens, tok)
+		}
+	}
+	return strings.Join(setKernelArg(tokens, "8250.nr_uarts", "0"), " ")
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// Buffer size used whenever the launcher itself reads or writes snapshot
+// data. Set from -snapshot-buf-size.
+var snapshotBufSize = 1 << 20
+
+// Bytes a file takes on disk. Holes take none, such as the clean pages of a
+// diff memory file.
+func allocatedSize(path string) (int64, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0, err
+	}
+	return info.Sys().(*syscall.Stat_t).Blocks * 512, nil
+}
+
+// Parse a byte size such as "4096", "512K", "1M" or "2G".
+func parseSize(s string) (int64, error) {
+	units := map[string]int64{
+		"":  1,
+		"K": 1 << 10,
+		"M": 1 << 20,
+		"G": 1 << 30,
+	}
+
+	str := strings.ToUpper(strings.TrimSpace(s))
+	str = strings.TrimSuffix(strings.TrimSuffix(str, "B"), "I")
+	unit := ""
+	if n := len(str); n > 0 && strings.ContainsAny(str[n-1:], "KMG") {
+		unit = str[n-1:]
+		str = str[:n-1]
+	}
+
+	value, err := strconv.ParseInt(str, 10, 64)
+	if err != nil || value < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return value * units[unit], nil
+}
+
+// Copy snapshot data using a buffer of snapshotBufSize bytes.
+func copySnapshotData(dst io.Writer, src io.Reader) (int64, error) {
+	// Hide ReadFrom/WriteTo so that the configured buffer is actually used
+	return io.CopyBuffer(struct{ io.Writer }{dst}, struct{ io.Reader }{src},
+		make([]byte, snapshotBufSize))
+}
+
+// Map a whole file read-only. The returned function unmaps it.
+func mapFile(path string) ([]byte, func(), error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, nil, err
+	}
+	if info.Size() == 0 {
+		return nil, func() {}, nil
+	}
+
+	data, err := syscall.Mmap(int(f.Fd()), 0, int(info.Size()), syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to map %s: %v", path, err)
+	}
+	return data, func() { syscall.Munmap(data) }, nil
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+
+	log "github.com/sirupsen/logrus"
+
+	firecracker "github.com/firecracker-microvm/firecracker-go-sdk"
+)
+
+// Parse an octal permission mode for the API socket, such as 0660.
+// Connecting to a UDS takes write permission, so a mode without any write
+// bit locks everyone out.
+func parseSocketMode(s string) (os.FileMode, error) {
+	mode, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || mode > 0777 {
+		return 0, fmt.Errorf("invalid socket mode %q, expected octal permissions such as 0660", s)
+	}
+	if mode&0222 == 0 {
+		return 0, fmt.Errorf("socket mode %q lets no one connect, it needs a write bit", s)
+	}
+	return os.FileMode(mode), nil
+}
+
+// Give the API socket mode, if set, once it's there.
+func applySocketMode(socketPath string, mode os.FileMode) error {
+	if mode == 0 {
+		return nil
+	}
+	if err := os.Chmod(socketPath, mode); err != nil {
+		return fmt.Errorf("failed to set the mode of %s: %v", socketPath, err)
+	}
+	log.Infof("API socket %s set to mode %#o", socketPath, mode)
+	return nil
+}
+
+// Handler applying the socket mode right after the SDK waited for the
+// socket of the VMM it started.
+func newSocketModeHandler(mode os.FileMode) firecracker.Handler {
+	return firecracker.Handler{
+		Name: "fcinit.SetSocketMode",
+		Fn: func(ctx context.Context, m *firecracker.Machine) error {
+			return applySocketMode(m.Cfg.SocketPath, mode)
+		},
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	httptransport "github.com/go-openapi/runtime/client"
+	log "github.com/sirupsen/logrus"
+
+	firecracker "github.com/firecracker-microvm/firecracker-go-sdk"
+	"github.com/firecracker-microvm/firecracker-go-sdk/client"
+)
+
+// Whether every Firecracker API request is logged, set by -trace-api
+var traceAPI bool
+
+const (
+	// Longer strings in a traced body, like snapshot paths, are shortened
+	traceMaxString = 64
+	// Traced bodies are cut after this many bytes
+	traceMaxBody = 4096
+)
+
+// Logs the requests going through it and their responses
+type tracingTransport struct {
+	next http.RoundTripper
+}
+
+func (t tracingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var body []byte
+	if req.Body != nil {
+		var err error
+		body, err = ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+	log.Infof("API %s %s%s", req.Method, req.URL.Path, traceBody(body))
+
+	start := time.Now()
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		log.Infof("API %s %s failed after %v: %v", req.Method, req.URL.Path, time.Since(start), err)
+		return nil, err
+	}
+	log.Infof("API %s %s: %s in %v", req.Method, req.URL.Path, resp.Status, time.Since(start))
+	return resp, nil
+}
+
+// Format a request body for the log: pretty printed JSON on its own lines,
+// with long strings shortened and the whole cut at traceMaxBody.
+func traceBody(body []byte) string {
+	if len(bytes.TrimSpace(body)) == 0 {
+		return ""
+	}
+	var v interface{}
+	if err := json.Unmarshal(body, &v); err == nil {
+		if pretty, err := json.MarshalIndent(shortenStrings(v), "", "  "); err == nil {
+			body = pretty
+		}
+	}
+	if len(body) > traceMaxBody {
+		return fmt.Sprintf("\n%s\n... (%d bytes total)", body[:traceMaxBody], len(body))
+	}
+	return "\n" + string(body)
+}
+
+// Shorten the strings of a decoded JSON value, keeping their start and end
+// since that's where paths differ.
+func shortenStrings(v interface{}) interface{} {
+	switch v := v.(type) {
+	case string:
+		if len(v) > traceMaxString {
+			keep := traceMaxString / 2
+			return fmt.Sprintf("%s...%s", v[:keep], v[len(v)-keep:])
+		}
+	case map[string]interface{}:
+		for k, e := range v {
+			v[k] = shortenStrings(e)
+		}
+	case []interface{}:
+		for i, e := range v {
+			v[i] = shortenStrings(e)
+		}
+	}
+	return v
+}
+
+// Wrap an API transport for tracing if -trace-api is set.
+func traceTransport(rt http.RoundTripper) http.RoundTripper {
+	if !traceAPI {
+		return rt
+	}
+	return tracingTransport{next: rt}
+}
+
+// Create a client for the API behind socketPath, tracing its requests if
+// -trace-api is set.
+func newAPIClient(socketPath string) *firecracker.Client {
+	logger := log.NewEntry(log.New())
+	if !traceAPI {
+		return firecracker.NewClient(socketPath, logger, false)
+	}
+
+	transport := firecracker.NewUnixSocketTransport(socketPath, logger, false)
+	if rt, ok := transport.(*httptransport.Runtime); ok {
+		rt.Transport = traceTransport(rt.Transport)
+	}
+	ops := client.New(transport, nil).Operations
+	return firecracker.NewClient(socketPath, logger, false, firecracker.WithOpsClient(ops))
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	firecracker "github.com/firecracker-microvm/firecracker-go-sdk"
+)
+
+// How long the old VMM gets to exit once told to, and then to be reaped by
+// its parent
+const upgradeStopTimeout = 5 * time.Second
+
+// Socket of a VM upgraded from socketPath. The launcher that started the
+// old VMM removes socketPath once it's reaped, so the new VMM can't bind it.
+func upgradedSocketPath(socketPath string) string {
+	if i := strings.Index(socketPath, ".upgraded-"); i >= 0 {
+		socketPath = socketPath[:i]
+	}
+	return socketPath + ".upgraded-" + time.Now().UTC().Format("20060102T150405")
+}
+
+// Whether a process has exited. Processes we aren't the parent of stay
+// zombies until their own parent reaps them.
+func processGone(pid int) bool {
+	stat, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return true
+	}
+	fields := strings.Fields(string(stat[strings.LastIndexByte(string(stat), ')')+1:]))
+	return len(fields) > 0 && fields[0] == "Z"
+}
+
+// Check that binary can load the snapshot at snapshotPath.
+func checkSnapshotVersion(binary string, snapshotPath string) error {
+	version, err := runTool(binary, "--version")
+	if err != nil {
+		return err
+	}
+	snapVersion, err := runTool(binary, "--describe-snapshot", snapshotPath+".file")
+	if err != nil {
+		return fmt.Errorf("%s can't read the snapshot: %v", binary, err)
+	}
+	log.Infof("Snapshot version %s, new Firecracker %s", snapVersion, strings.SplitN(version, "\n", 2)[0])
+	return nil
+}
+
+// Restore a snapshot and resume it as opts.onResumeFail says, turning the
+// panics of restoreVM into an error. A VM left paused is returned with
+// errLeftPaused.
+func tryRestore(socketPath string, snapshotPath string, opts vmOptions) (vm *restoredVM, err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf("%v", p)
+		}
+	}()
+
+	vm = restoreVM(socketPath, snapshotPath, opts)
+	if err := resumeWithPolicy(context.Background(), vm, opts); err != nil {
+		if err == errLeftPaused {
+			return vm, err
+		}
+		vm.stop()
+		return nil, err
+	}
+	recordEvent("resume", socketPath, "")
+	return vm, nil
+}
+
+// Move the VM behind socketPath to the Firecracker binary newBinary: take a
+// full snapshot to snapshotPath, stop the old VMM and restore the snapshot
+// under the new one on a new socket, see upgradedSocketPath. If the new VMM
+// can't restore the VM, the old binary restores it instead. The VM is
+// locked until it runs again, then runs under this launcher. Returns the
+// launcher exit code.
+func hotUpgrade(socketPath string, snapshotPath string, newBinary string, force bool, opts vmOptions) int {
+	if err := requireFiles(newBinary); err != nil {
+		panic(err)
+	}
+	unlock := lockVM(socketPath, force)
+	defer unlock()
+
+	pid, err := findVMMPid(socketPath)
+	if err != nil {
+		panic(err)
+	}
+	// Keep the old binary around for a rollback
+	oldBinary, err := os.Readlink(fmt.Sprintf("/proc/%d/exe", pid))
+	if err != nil {
+		panic(fmt.Errorf("failed to find the running Firecracker binary: %v", err))
+	}
+
+	ctx := context.Background()
+	cfg := firecracker.Config{SocketPath: socketPath}
+	machine, err := firecracker.NewMachine(ctx, cfg, firecracker.WithClient(newAPIClient(cfg.SocketPath)),
+		firecracker.WithLogger(log.NewEntry(log.New())))
+	if err != nil {
+		panic(fmt.Errorf("failed to create new machine: %v", err))
+	}
+
+	// The downtime starts with the pause
+	start := time.Now()
+	if err := pauseWithRetry(ctx, machine); err != nil {
+		panic(err)
+	}
+	err = fullSnapshot(ctx, machine, snapshotPath)
+	if err == nil {
+		err = checkSnapshotVersion(newBinary, snapshotPath)
+	}
+	if err != nil {
+		// Nothing was stopped yet, leave the VM as it was
+		machine.ResumeVM(ctx)
+		recordEvent("resume", socketPath, "")
+		panic(fmt.Errorf("not upgrading: %v", err))
+	}
+	fmt.Println("Snapshot duration:", time.Since(start))
+
+	// The launcher that started it is still waiting for it
+	if err := markHandover(socketPath, pid); err != nil {
+		machine.ResumeVM(ctx)
+		panic(fmt.Errorf("failed to mark the VM as handed over: %v", err))
+	}
+	if err := syscall.Kill(pid, syscall.SIGTERM); err != nil {
+		os.Remove(handoverPath(socketPath))
+		machine.ResumeVM(ctx)
+		panic(fmt.Errorf("failed to stop the old VMM: %v", err))
+	}
+	recordEvent("stop", socketPath, "")
+	// A zombie is gone only once its parent reaped it
+	killed := time.Now().Add(upgradeStopTimeout)
+	for processAlive(pid) {
+		switch {
+		case time.Now().After(killed.Add(upgradeStopTimeout)):
+			panic(fmt.Errorf("old VMM %d not reaped by its parent, the VM is down, its snapshot is %s", pid, snapshotPath))
+		case time.Now().After(killed):
+			syscall.Kill(pid, syscall.SIGKILL)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	upgraded := upgradedSocketPath(socketPath)
+	opts.firecracker = newBinary
+	vm, err := tryRestore(upgraded, snapshotPath, opts)
+	if err == errLeftPaused {
+		// Left for inspection rather than rolled back, until it's stopped
+		// from outside
+		unlock()
+		defer vm.stop()
+		vm.wait()
+		return exitFailure
+	}
+	if err != nil {
+		log.Errorf("Restore under %s failed, rolling back to %s: %v", newBinary, oldBinary, err)
+		opts.firecracker = oldBinary
+		vm, err = tryRestore(upgraded, snapshotPath, opts)
+		if err != nil && err != errLeftPaused {
+			panic(fmt.Errorf("rollback failed, the VM is down: %v", err))
+		}
+		fmt.Println("Rolled back, downtime:", time.Since(start))
+		fmt.Println("VM socket:", upgraded)
+		unlock()
+		defer vm.stop()
+		vm.wait()
+		return exitFailure
+	}
+	fmt.Println("Upgraded to", newBinary+", downtime:", time.Since(start))
+	fmt.Println("VM socket:", upgraded)
+	unlock()
+	defer vm.stop()
+
+	// wait for the VMM to exit
+	err = vm.wait()
+	// Upgraded again
+	handed := handedOver(upgraded, vm.pid)
+	if err != nil && !stopping() && !handed {
+		panic(fmt.Errorf("Wait returned an error %s", err))
+	}
+	return exitOK
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"syscall"
+)
+
+// Compute the SHA-256 of a file by memory-mapping it and hashing it in
+// snapshotBufSize chunks, so that large memory files are never buffered.
+func hashFile(path string) (string, int64, error) {
+	data, unmap, err := mapFile(path)
+	if err != nil {
+		return "", 0, err
+	}
+	defer unmap()
+	syscall.Madvise(data, syscall.MADV_SEQUENTIAL)
+
+	h := sha256.New()
+	for off := 0; off < len(data); off += snapshotBufSize {
+		end := off + snapshotBufSize
+		if end > len(data) {
+			end = len(data)
+		}
+		h.Write(data[off:end])
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), int64(len(data)), nil
+}
+
+// Check the memory file of a snapshot against the size and checksum in its
+// manifest, without starting Firecracker.
+func validateMem(snapshotPath string) error {
+	m, err := readManifest(snapshotPath)
+	if err != nil {
+		return err
+	}
+	if m == nil || m.MemSHA256 == "" {
+		return fmt.Errorf("no checksum recorded for snapshot %s", snapshotPath)
+	}
+
+	sum, size, err := hashFile(snapshotPath + ".mem")
+	if err != nil {
+		return err
+	}
+	if size != m.MemFileSize {
+		return fmt.Errorf("size is %d, manifest expects %d", size, m.MemFileSize)
+	}
+	if sum != m.MemSHA256 {
+		return fmt.Errorf("sha256 is %s, manifest expects %s", sum, m.MemSHA256)
+	}
+	return nil
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"path/filepath"
+	"testing"
+)
+
+// Serve the Firecracker API on a temporary socket with a fixed response
+func fakeAPI(t *testing.T, status int, body string) string {
+	socket := filepath.Join(t.TempDir(), "api.sock")
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+		fmt.Fprint(w, body)
+	})}
+	go srv.Serve(l)
+	t.Cleanup(func() { srv.Close() })
+	return socket
+}
+
+func TestUnknownDriveField(t *testing.T) {
+	for _, c := range []struct {
+		name   string
+		status int
+		body   string
+		want   bool
+	}{
+		{"release without vhost-user", http.StatusBadRequest,
+			`{"fault_message":"An error occurred when deserializing the json body of a request: unknown field ` +
+				"`socket`" + `, expected one of ` + "`drive_id`, `path_on_host`" + `."}`, true},
+		{"bad backend socket", http.StatusBadRequest,
+			`{"fault_message":"Unable to create the block device: vhost-user socket /run/vhost.sock not found"}`, false},
+		{"other unknown field", http.StatusBadRequest,
+			`{"fault_message":"unknown field ` + "`io_engine`" + `"}`, false},
+		{"server error", http.StatusInternalServerError, "unknown field `socket`", false},
+	} {
+		socket := fakeAPI(t, c.status, c.body)
+		err := apiRequest(context.Background(), socket, http.MethodPut, "/drives/"+vhostDriveID, map[string]string{})
+		if err == nil {
+			t.Errorf("%s: no error", c.name)
+			continue
+		}
+		if got := unknownDriveField(err, "socket"); got != c.want {
+			t.Errorf("%s: unknownDriveField(%v) = %v, want %v", c.name, err, got, c.want)
+		}
+	}
+
+	// Not even an API response
+	if unknownDriveField(fmt.Errorf("dial unix api.sock: connect: no such file or directory"), "socket") {
+		t.Error("a connection error taken for an unknown field")
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Guest CID of the -vsock device
+const guestCID = 3
+
+// How long the guest agent gets to answer a -vsock-serve request
+const vsockRequestTimeout = 30 * time.Second
+
+// A VM of the -vsock-serve pool, restored and resumed, with its guest agent
+// connected back to the host
+type warmVM struct {
+	name string
+	vm   *restoredVM
+	conn net.Conn
+	dir  string
+	// From the start of the restore until the agent connected
+	warmup time.Duration
+}
+
+func (w *warmVM) stop(states *vmStates) {
+	states.set(w.name, stateDraining)
+	w.conn.Close()
+	w.vm.stop()
+	os.RemoveAll(w.dir)
+	states.remove(w.name)
+}
+
+// Send a request to the guest agent and read its response, which ends when
+// the agent closes the connection.
+func (w *warmVM) handle(request string) ([]byte, error) {
+	w.conn.SetDeadline(time.Now().Add(vsockRequestTimeout))
+	if _, err := fmt.Fprintln(w.conn, request); err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(w.conn)
+}
+
+// Path the host listens on for guest connections to port on the vsock
+// device with the host UDS udsPath, see Firecracker's vsock docs.
+func vsockListenPath(dir string, udsPath string, port uint32) string {
+	path := fmt.Sprintf("%s_%d", udsPath, port)
+	if filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(dir, path)
+}
+
+// Restore snapshotPath into a VMM working in dir and wait for the guest
+// agent to connect to port.
+func restoreWarm(dir string, snapshotPath string, port uint32, opts vmOptions) (w *warmVM, err error) {
+	// restoreVM panics on failure, after cleaning up
+	defer func() {
+		if p := recover(); p != nil {
+			os.RemoveAll(dir)
+			err = fmt.Errorf("%v", p)
+		}
+	}()
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	// Listening before the resume, the agent connects right away
+	l, err := net.Listen("unix", vsockListenPath(dir, opts.vsock, port))
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	defer l.Close()
+
+	start := time.Now()
+	opts.workDir = dir
+	vm := restoreVM(filepath.Join(dir, "api.sock"), snapshotPath, opts)
+	if err := resumeRestored(vm, opts); err != nil {
+		vm.stop()
+		os.RemoveAll(dir)
+		return nil, err
+	}
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		if conn, err := l.Accept(); err == nil {
+			accepted <- conn
+		}
+	}()
+	select {
+	case conn := <-accepted:
+		return &warmVM{vm: vm, conn: conn, dir: dir, warmup: time.Since(start)}, nil
+	case <-time.After(opts.readyTimeout):
+		vm.stop()
+		os.RemoveAll(dir)
+		return nil, fmt.Errorf("guest agent didn't connect to vsock port %d within %v", port, opts.readyTimeout)
+	}
+}
+
+// Serve the requests read from stdin, one per line, each by a fresh VM
+// restored from snapshotPath. The guest agent connects to the host on vsock
+// port, gets the request and sends back the response, which is printed.
+// poolSize VMs are kept restored ahead so requests don't wait for restores.
+// Their states are tracked in states, if not nil.
+func vsockServe(socketPath string, snapshotPath string, port uint32, poolSize int, states *vmStates, opts vmOptions) int {
+	// Requests come from stdin, the VMMs don't get it
+	opts.detached = true
+	poolDir := socketPath + ".pool"
+	registerPath("pool directory", poolDir)
+	defer os.RemoveAll(poolDir)
+
+	// A slot is taken for every VM being restored or waiting in the pool
+	slots := make(chan struct{}, poolSize)
+	pool := make(chan *warmVM, poolSize)
+	failed := make(chan error, 1)
+	quit := make(chan struct{})
+	filled := make(chan struct{})
+	go func() {
+		defer close(filled)
+		for n := 0; ; n++ {
+			select {
+			case <-quit:
+				return
+			default:
+			}
+			select {
+			case slots <- struct{}{}:
+			case <-quit:
+				return
+			}
+			name := "vm-" + strconv.Itoa(n)
+			states.set(name, stateRestoring)
+			w, err := restoreWarm(filepath.Join(poolDir, strconv.Itoa(n)), snapshotPath, port, opts)
+			if err != nil {
+				states.remove(name)
+				failed <- err
+				return
+			}
+			w.name = name
+			states.set(name, stateReady)
+			log.Debugf("Pool VM %s ready after %v", name, w.warmup)
+			pool <- w
+		}
+	}()
+	defer func() {
+		close(quit)
+		<-filled
+		close(pool)
+		for w := range pool {
+			w.stop(states)
+		}
+	}()
+
+	var latencies []time.Duration
+	status := exitOK
+	scanner := bufio.NewScanner(os.Stdin)
+	for n := 1; scanner.Scan(); n++ {
+		var w *warmVM
+		select {
+		case w = <-pool:
+		case err := <-failed:
+			log.Errorf("Failed to restore a VM for the pool: %v", err)
+			return exitFailure
+		}
+		<-slots
+		// Busy with the request, then stopped
+		states.set(w.name, stateDraining)
+
+		start := time.Now()
+		response, err := w.handle(scanner.Text())
+		latency := time.Since(start)
+		w.stop(states)
+		if err != nil {
+			log.Errorf("Request %d failed after %v: %v", n, latency, err)
+			status = exitFailure
+			continue
+		}
+		os.Stdout.Write(response)
+		latencies = append(latencies, latency)
+		log.Infof("Request %d: %v, VM restored and connected in %v", n, latency, w.warmup)
+	}
+	if err := scanner.Err(); err != nil {
+		panic(err)
+	}
+
+	if len(latencies) != 0 {
+		sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+		log.Infof("Served %d requests, latency p50 %v, max %v",
+			len(latencies), latencies[len(latencies)/2], latencies[len(latencies)-1])
+	}
+	return status
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// MMDS key the guest agent polls for warm-up requests
+const warmupIOKey = "warmup_io"
+
+// Ask the guest agent through MMDS to read the given guest paths, priming
+// its page cache and the host's disk cache, and wait until the agent prints
+// "warmup_io done <id>" on the console. A restored VM starts with an empty
+// data store unless storeSet, so the request replaces it then. Returns how
+// long that took.
+func warmupGuestIO(vm *restoredVM, paths []string, timeout time.Duration, storeSet bool) (time.Duration, error) {
+	request := newGuestRequest(vm.machine, warmupIOKey, vm.console)
+	request.replace = !storeSet
+	start := time.Now()
+	if err := request.set(context.Background(), map[string]interface{}{"paths": strings.Join(paths, " ")}); err != nil {
+		return 0, fmt.Errorf("failed to ask the guest to warm up: %v", err)
+	}
+	if !request.wait(timeout) {
+		return time.Since(start), fmt.Errorf("guest warm-up not done after %v", timeout)
+	}
+	return time.Since(start), nil
+}
+
+// Parse a comma separated list of absolute guest paths.
+func parseGuestPaths(list string) ([]string, error) {
+	var paths []string
+	for _, p := range strings.Split(list, ",") {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+		if !strings.HasPrefix(p, "/") || strings.ContainsAny(p, " \t\n") {
+			return nil, fmt.Errorf("invalid guest path %q", p)
+		}
+		paths = append(paths, p)
+	}
+	return paths, nil
+}